@@ -0,0 +1,283 @@
+package IPtProxy
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+
+	ptlog "gitlab.torproject.org/tpo/anti-censorship/pluggable-transports/lyrebird/common/log"
+)
+
+// Vanilla - Transport name of plain bridges without a pluggable transport, as used by Tor's circumvention settings
+// API.
+const Vanilla = "vanilla"
+
+// moatBridges - A transport recommendation of Tor's circumvention settings API.
+type moatBridges struct {
+	Type          string   `json:"type"`
+	Source        string   `json:"source"`
+	BridgeStrings []string `json:"bridge_strings"`
+}
+
+// moatSetting - One entry of the "settings" list of Tor's circumvention settings API.
+type moatSetting struct {
+	Bridges moatBridges `json:"bridges"`
+}
+
+// moatError - An error returned by Tor's circumvention settings API.
+type moatError struct {
+	Code   int    `json:"code"`
+	Detail string `json:"detail"`
+}
+
+// moatSettingsResponse - The response of the `/settings` and `/defaults` endpoints of Tor's circumvention settings
+// API. Also used for the per-country entries of the `/map` endpoint.
+type moatSettingsResponse struct {
+	Settings []moatSetting `json:"settings"`
+	Country  string        `json:"country"`
+	Errors   []moatError   `json:"errors"`
+}
+
+// circumventionSetting - A resolved transport recommendation.
+type circumventionSetting struct {
+	transport string
+	source    string
+	lines     []string
+}
+
+// CircumventionSettings - Transport recommendations of Tor's circumvention settings API, in the order they should be
+// tried. Created by Controller.ParseCircumventionSettings and Controller.CircumventionSettingsForCountry.
+type CircumventionSettings struct {
+
+	// Country - The country code the recommendations are for, if known.
+	Country string
+
+	settings []circumventionSetting
+}
+
+// Count - The number of recommendations.
+func (s *CircumventionSettings) Count() int {
+	return len(s.settings)
+}
+
+// Transport - The transport of a recommendation.
+//
+// @param index The index of the recommendation.
+//
+// @return one of the constants `Obfs4`, `MeekLite`, `Webtunnel`, `Snowflake`, `Vanilla` or another transport name,
+// or an empty string, if the index is out of range.
+func (s *CircumventionSettings) Transport(index int) string {
+	if index < 0 || index >= len(s.settings) {
+		return ""
+	}
+
+	return s.settings[index].transport
+}
+
+// Source - Where the bridges of a recommendation come from.
+//
+// @param index The index of the recommendation.
+//
+// @return e.g. "builtin" or "bridgedb", or an empty string, if the index is out of range.
+func (s *CircumventionSettings) Source(index int) string {
+	if index < 0 || index >= len(s.settings) {
+		return ""
+	}
+
+	return s.settings[index].source
+}
+
+// BridgeLines - The bridges of a recommendation.
+//
+// @param index The index of the recommendation.
+//
+// @return newline-separated bridge lines without the leading "Bridge" keyword, ready for Controller.TorrcLines.
+// Built-in bridges not contained in the response are taken from the defaults. See Controller.LoadDefaults.
+func (s *CircumventionSettings) BridgeLines(index int) string {
+	if index < 0 || index >= len(s.settings) {
+		return ""
+	}
+
+	return strings.Join(s.settings[index].lines, "\n")
+}
+
+// ParseCircumventionSettings - Parse the response of the `/settings` or `/defaults` endpoint of Tor's circumvention
+// settings API (moat).
+//
+// @param response The JSON response as fetched by the app.
+//
+// @return the recommendations, which can be empty, if the API has none for the country.
+//
+// @throws if the JSON is invalid, if the API returned an error, or if a bridge line is invalid.
+func (c *Controller) ParseCircumventionSettings(response string) (*CircumventionSettings, error) {
+	var r moatSettingsResponse
+
+	if err := json.Unmarshal([]byte(response), &r); err != nil {
+		ptlog.Errorf("Failed to parse circumvention settings: %s", err.Error())
+		return nil, err
+	}
+
+	if len(r.Errors) > 0 {
+		err := fmt.Errorf("circumvention settings API error %d: %s", r.Errors[0].Code, r.Errors[0].Detail)
+
+		ptlog.Errorf("Failed to parse circumvention settings: %s", err.Error())
+		return nil, err
+	}
+
+	return c.resolveCircumventionSettings(r.Country, r.Settings)
+}
+
+// LoadCircumventionMap - Load the response of the `/map` endpoint of Tor's circumvention settings API (moat), so the
+// recommendations for a country are available offline via Controller.CircumventionSettingsForCountry.
+//
+// @param response The JSON response as fetched by the app.
+//
+// @throws if the JSON is invalid.
+func (c *Controller) LoadCircumventionMap(response string) error {
+	var m map[string]moatSettingsResponse
+
+	if err := json.Unmarshal([]byte(response), &m); err != nil {
+		ptlog.Errorf("Failed to parse circumvention map: %s", err.Error())
+		return err
+	}
+
+	c.circumventionMap = make(map[string][]moatSetting, len(m))
+
+	for country, r := range m {
+		c.circumventionMap[strings.ToLower(country)] = r.Settings
+	}
+
+	ptlog.Noticef("Loaded circumvention map for %d countries", len(c.circumventionMap))
+
+	return nil
+}
+
+// CircumventionSettingsForCountry - The recommendations for a country from the map loaded with
+// Controller.LoadCircumventionMap.
+//
+// @param country The two-letter country code, e.g. "cn".
+//
+// @return the recommendations, which are empty, if the map contains none for the country.
+//
+// @throws if a bridge line is invalid.
+func (c *Controller) CircumventionSettingsForCountry(country string) (*CircumventionSettings, error) {
+	country = strings.ToLower(country)
+
+	return c.resolveCircumventionSettings(country, c.circumventionMap[country])
+}
+
+// LoadBuiltinBridges - Load the response of the `/builtin` endpoint of Tor's circumvention settings API (moat)
+// as new defaults. See Controller.LoadDefaults.
+//
+// @param response The JSON response as fetched by the app.
+//
+// @throws if the JSON or a bridge line is invalid. The current defaults stay in use then.
+func (c *Controller) LoadBuiltinBridges(response string) error {
+	var bridges map[string][]string
+
+	if err := json.Unmarshal([]byte(response), &bridges); err != nil {
+		ptlog.Errorf("Failed to load built-in bridges: %s", err.Error())
+		return err
+	}
+
+	d, err := newDefaultBridges("moat", bridges)
+	if err != nil {
+		ptlog.Errorf("Failed to load built-in bridges: %s", err.Error())
+		return err
+	}
+
+	c.loadDefaults(d)
+
+	return nil
+}
+
+// resolveCircumventionSettings normalizes the transport names and fills in missing built-in bridges from the defaults.
+func (c *Controller) resolveCircumventionSettings(country string, settings []moatSetting) (*CircumventionSettings, error) {
+	s := &CircumventionSettings{Country: country}
+
+	for _, setting := range settings {
+		transport := setting.Bridges.Type
+		if transport == "meek" {
+			transport = MeekLite
+		}
+
+		var lines []string
+
+		for _, line := range setting.Bridges.BridgeStrings {
+			// Plain bridges start with their address.
+			if transport != Vanilla {
+				if _, err := parseBridgeLine(line); err != nil {
+					return nil, err
+				}
+			}
+
+			lines = append(lines, strings.Join(bridgeLineFields(line), " "))
+		}
+
+		if len(lines) == 0 && setting.Bridges.Source == "builtin" {
+			lines = c.bridgeDefaults().lines[transport]
+		}
+
+		s.settings = append(s.settings, circumventionSetting{transport, setting.Bridges.Source, lines})
+	}
+
+	return s, nil
+}
+
+// StartCircumvention - Apply a recommendation: Configure the Controller from its bridges (see
+// Controller.UseDefaults) and start its transport, if it's not running, yet. If it is running and the
+// recommendation changed its Controller-level settings, it's restarted, which resets its connections and changes
+// its local address. Update tor's configuration afterwards, e.g. with Controller.WriteTorrc.
+//
+// @param settings The recommendations.
+//
+// @param index The index of the recommendation to apply.
+//
+// @param proxy The proxy to use. See Controller.Start. Needs to be empty for `Snowflake`.
+//
+// @return the bridge lines to hand to tor, e.g. with Controller.WriteTorrc.
+//
+// @throws if the index is out of range, if the recommendation has no bridges, or if the transport could not be
+// started.
+func (c *Controller) StartCircumvention(settings *CircumventionSettings, index int, proxy string) (string, error) {
+	if settings == nil || index < 0 || index >= len(settings.settings) {
+		return "", errors.New("no such circumvention setting")
+	}
+
+	s := settings.settings[index]
+
+	if len(s.lines) == 0 {
+		err := fmt.Errorf("no bridges for %s", s.transport)
+
+		ptlog.Errorf("Failed to apply circumvention setting: %s", err.Error())
+		return "", err
+	}
+
+	if s.transport != Vanilla {
+		if s.transport == Snowflake || s.transport == MeekLite {
+			settings := c.controllerSettings(s.transport)
+
+			if err := c.configureFromBridgeLines(s.transport, s.lines); err != nil {
+				ptlog.Errorf("Failed to apply circumvention setting: %s", err.Error())
+				return "", err
+			}
+
+			// A running transport only picks up changed settings on its next start.
+			if c.isRunning(s.transport) && !slices.Equal(settings, c.controllerSettings(s.transport)) {
+				ptlog.Noticef("Restarting %s to apply circumvention setting", s.transport)
+
+				c.Stop(s.transport)
+			}
+		}
+
+		if !c.isRunning(s.transport) {
+			if err := c.Start(s.transport, proxy); err != nil {
+				return "", err
+			}
+		}
+	}
+
+	return strings.Join(s.lines, "\n"), nil
+}
@@ -0,0 +1,254 @@
+package IPtProxy
+
+import (
+	"strings"
+	"sync"
+	"testing"
+
+	pt "gitlab.torproject.org/tpo/anti-censorship/pluggable-transports/goptlib"
+	"gitlab.torproject.org/tpo/anti-censorship/pluggable-transports/lyrebird/transports"
+	"gitlab.torproject.org/tpo/anti-censorship/pluggable-transports/lyrebird/transports/base"
+)
+
+// Canned responses of Tor's circumvention settings API (moat).
+const (
+	moatSettingsFixture = `{
+  "settings": [
+    {"bridges": {"type": "snowflake", "source": "builtin"}},
+    {"bridges": {"type": "obfs4", "source": "bridgedb", "bridge_strings": [
+      "Bridge obfs4 192.0.2.1:443 0123456789ABCDEF0123456789ABCDEF01234567 cert=AAAA iat-mode=0",
+      "obfs4  192.0.2.2:80 89ABCDEF0123456789ABCDEF0123456789ABCDEF cert=BBBB iat-mode=0"
+    ]}},
+    {"bridges": {"type": "vanilla", "source": "bridgedb", "bridge_strings": [
+      "192.0.2.3:9001 0123456789ABCDEF0123456789ABCDEF01234567"
+    ]}}
+  ],
+  "country": "cn"
+}`
+
+	moatErrorFixture = `{"errors": [{"code": 404, "detail": "No settings found for country xx"}]}`
+
+	moatMapFixture = `{
+  "cn": {"settings": [
+    {"bridges": {"type": "meek", "source": "builtin"}},
+    {"bridges": {"type": "snowflake", "source": "builtin"}}
+  ]},
+  "RU": {"settings": [
+    {"bridges": {"type": "obfs4", "source": "builtin"}}
+  ]}
+}`
+
+	moatBuiltinFixture = `{
+  "meek": [
+    "meek_lite 192.0.2.20:80 url=https://meek.example/ front=front1.example utls=HelloRandomizedALPN",
+    "meek_lite 192.0.2.20:80 url=https://meek.example/ front=front2.example utls=HelloRandomizedALPN"
+  ],
+  "obfs4": [
+    "obfs4 192.0.2.30:443 0123456789ABCDEF0123456789ABCDEF01234567 cert=CCCC iat-mode=0"
+  ]
+}`
+)
+
+var initTransportsOnce sync.Once
+
+// newTestController creates a Controller like NewController, but without touching the logging and with the
+// transports registered only once per process.
+func newTestController(t *testing.T) *Controller {
+	initTransportsOnce.Do(func() {
+		if err := transports.Init(); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	return &Controller{
+		stateDir:    t.TempDir(),
+		listeners:   make(map[string]*pt.SocksListener),
+		shutdown:    make(map[string]chan struct{}),
+		proxies:     make(map[string]*upstreamProxy),
+		connections: make(map[string]*connections),
+		factories:   make(map[string]base.ClientFactory),
+		extraArgs:   make(map[string]*pt.Args),
+	}
+}
+
+func TestParseCircumventionSettings(t *testing.T) {
+	c := newTestController(t)
+
+	s, err := c.ParseCircumventionSettings(moatSettingsFixture)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if s.Country != "cn" || s.Count() != 3 {
+		t.Fatalf("got country %s with %d settings, expected cn with 3", s.Country, s.Count())
+	}
+
+	if s.Transport(0) != Snowflake || s.Source(0) != "builtin" {
+		t.Errorf("unexpected first setting %s from %s", s.Transport(0), s.Source(0))
+	}
+
+	// Built-in bridges are taken from the defaults.
+	if lines := s.BridgeLines(0); lines == "" || lines != c.DefaultBridgeLines(Snowflake) {
+		t.Errorf("built-in Snowflake bridges not taken from defaults: %q", lines)
+	}
+
+	expected := "obfs4 192.0.2.1:443 0123456789ABCDEF0123456789ABCDEF01234567 cert=AAAA iat-mode=0\n" +
+		"obfs4 192.0.2.2:80 89ABCDEF0123456789ABCDEF0123456789ABCDEF cert=BBBB iat-mode=0"
+
+	if s.Transport(1) != Obfs4 || s.BridgeLines(1) != expected {
+		t.Errorf("unexpected obfs4 bridges %q", s.BridgeLines(1))
+	}
+
+	if s.Transport(2) != Vanilla || s.BridgeLines(2) != "192.0.2.3:9001 0123456789ABCDEF0123456789ABCDEF01234567" {
+		t.Errorf("unexpected vanilla bridges %q", s.BridgeLines(2))
+	}
+
+	if s.Transport(3) != "" || s.BridgeLines(-1) != "" {
+		t.Error("out of range index returned a setting")
+	}
+}
+
+func TestParseCircumventionSettingsError(t *testing.T) {
+	c := newTestController(t)
+
+	_, err := c.ParseCircumventionSettings(moatErrorFixture)
+	if err == nil || !strings.Contains(err.Error(), "404") {
+		t.Errorf("expected API error, got %v", err)
+	}
+
+	_, err = c.ParseCircumventionSettings(`{"settings": [{"bridges": {"type": "obfs4", "bridge_strings": ["obfs4"]}}]}`)
+	if err == nil {
+		t.Error("invalid bridge line accepted")
+	}
+}
+
+func TestCircumventionMap(t *testing.T) {
+	c := newTestController(t)
+
+	if err := c.LoadCircumventionMap(moatMapFixture); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := c.CircumventionSettingsForCountry("CN")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if s.Count() != 2 || s.Transport(0) != MeekLite || s.Transport(1) != Snowflake {
+		t.Errorf("unexpected settings for cn: %d, %s, %s", s.Count(), s.Transport(0), s.Transport(1))
+	}
+
+	s, err = c.CircumventionSettingsForCountry("ru")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if s.Count() != 1 || s.Transport(0) != Obfs4 {
+		t.Errorf("unexpected settings for ru: %d, %s", s.Count(), s.Transport(0))
+	}
+
+	s, err = c.CircumventionSettingsForCountry("xx")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if s.Count() != 0 {
+		t.Errorf("unexpected settings for unknown country: %d", s.Count())
+	}
+}
+
+func TestLoadBuiltinBridges(t *testing.T) {
+	c := newTestController(t)
+
+	snowflake := c.DefaultBridgeLines(Snowflake)
+
+	if err := c.LoadBuiltinBridges(moatBuiltinFixture); err != nil {
+		t.Fatal(err)
+	}
+
+	if c.DefaultsVersion() != "moat" {
+		t.Errorf("unexpected defaults version %s", c.DefaultsVersion())
+	}
+
+	if lines := c.DefaultBridgeLines(Obfs4); lines !=
+		"obfs4 192.0.2.30:443 0123456789ABCDEF0123456789ABCDEF01234567 cert=CCCC iat-mode=0" {
+		t.Errorf("unexpected obfs4 defaults %q", lines)
+	}
+
+	// Transports missing in the response keep their defaults.
+	if c.DefaultBridgeLines(Snowflake) != snowflake {
+		t.Error("Snowflake defaults were replaced")
+	}
+
+	if err := c.LoadBuiltinBridges(`{"obfs4": ["obfs4"]}`); err == nil {
+		t.Error("invalid bridge line accepted")
+	}
+}
+
+func TestStartCircumvention(t *testing.T) {
+	c := newTestController(t)
+
+	if err := c.LoadBuiltinBridges(moatBuiltinFixture); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := c.LoadCircumventionMap(moatMapFixture); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := c.CircumventionSettingsForCountry("cn")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = c.StartCircumvention(s, 2, ""); err == nil {
+		t.Error("out of range index accepted")
+	}
+
+	lines, err := c.StartCircumvention(s, 0, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Stop(MeekLite)
+
+	if lines != c.DefaultBridgeLines(MeekLite) {
+		t.Errorf("unexpected bridge lines %q", lines)
+	}
+
+	if c.MeekUrl != "https://meek.example/" || c.MeekFront != "front1.example" || c.MeekFronts != "front2.example" {
+		t.Errorf("Meek not configured: %s, %s, %s", c.MeekUrl, c.MeekFront, c.MeekFronts)
+	}
+
+	ln := c.listeners[MeekLite]
+	if ln == nil {
+		t.Fatal("Meek not started")
+	}
+
+	// Same settings: The running transport is kept.
+	if _, err = c.StartCircumvention(s, 0, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	if c.listeners[MeekLite] != ln {
+		t.Error("Meek restarted without changed settings")
+	}
+
+	// Changed settings: The running transport is restarted.
+	s, err = c.ParseCircumventionSettings(`{"settings": [{"bridges": {"type": "meek", "source": "bridgedb",
+		"bridge_strings": ["meek_lite 192.0.2.21:80 url=https://other.example/ front=front3.example"]}}]}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = c.StartCircumvention(s, 0, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	if c.listeners[MeekLite] == nil || c.listeners[MeekLite] == ln {
+		t.Error("Meek not restarted with changed settings")
+	}
+
+	if c.MeekUrl != "https://other.example/" || c.MeekFront != "front3.example" || c.MeekFronts != "" {
+		t.Errorf("Meek not reconfigured: %s, %s, %s", c.MeekUrl, c.MeekFront, c.MeekFronts)
+	}
+}
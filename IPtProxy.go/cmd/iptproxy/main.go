@@ -0,0 +1,154 @@
+// Command iptproxy runs IPtProxy as a managed pluggable transport client for tor, according to the
+// pluggable transport specification version 1.0.
+//
+// Configure it in your torrc like so:
+//
+//	ClientTransportPlugin obfs4,meek_lite,webtunnel,snowflake,dnstt exec /path/to/iptproxy
+//
+// tor passes the configuration via environment variables (`TOR_PT_MANAGED_TRANSPORT_VER`,
+// `TOR_PT_CLIENT_TRANSPORTS`, `TOR_PT_STATE_LOCATION`, `TOR_PT_PROXY`, `TOR_PT_EXIT_ON_STDIN_CLOSE`) and reads the
+// `CMETHOD` lines from stdout.
+//
+// An upstream proxy configured via `TOR_PT_PROXY` is used by the transports implemented in Lyrebird (obfs4,
+// meek_lite, webtunnel and the deprecated ones). Snowflake and DNSTT can't use a proxy. While a proxy is configured,
+// they are not started, so they never bypass it, and tor gets a `CMETHOD-ERROR` for them instead.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	"github.com/tladesignz/IPtProxy.git"
+	pt "gitlab.torproject.org/tpo/anti-censorship/pluggable-transports/goptlib"
+)
+
+func main() {
+	enableLogging := flag.Bool("enableLogging", false, "Log to TOR_PT_STATE_LOCATION/"+IPtProxy.LogFileName)
+	unsafeLogging := flag.Bool("unsafeLogging", false, "Disable the address scrubber")
+	logLevel := flag.String("logLevel", "ERROR", "Log level (ERROR/WARN/INFO/DEBUG)")
+	flag.Parse()
+
+	ptInfo, err := pt.ClientSetup(nil)
+	if err != nil {
+		// goptlib already reported the error to tor.
+		os.Exit(1)
+	}
+
+	stateDir, err := pt.MakeStateDir()
+	if err != nil {
+		envError(fmt.Sprintf("failed to create state directory: %s", err))
+		os.Exit(1)
+	}
+
+	controller := IPtProxy.NewController(stateDir, *enableLogging, *unsafeLogging, *logLevel, nil)
+	if controller == nil {
+		envError("failed to initialize IPtProxy")
+		os.Exit(1)
+	}
+
+	proxy := ""
+	if ptInfo.ProxyURL != nil {
+		proxy = ptInfo.ProxyURL.String()
+	}
+
+	var started []string
+	var addrs []net.Addr
+	var failed []string
+	var failures []error
+
+	// Only failures of transports which actually use the proxy are proxy failures.
+	var proxyUsed bool
+	var proxyErr error
+
+	// The PROXY line needs to be sent before any CMETHOD line, so start everything first.
+	for _, methodName := range ptInfo.MethodNames {
+		if proxy != "" && !IPtProxy.SupportsProxy(methodName) {
+			failed = append(failed, methodName)
+			failures = append(failures, fmt.Errorf("%s does not support proxies, but TOR_PT_PROXY is set", methodName))
+			continue
+		}
+
+		if err = controller.Start(methodName, proxy); err != nil {
+			failed = append(failed, methodName)
+			failures = append(failures, err)
+
+			if proxy != "" {
+				proxyErr = err
+			}
+
+			continue
+		}
+
+		addr, err := net.ResolveTCPAddr("tcp", controller.LocalAddress(methodName))
+		if err != nil {
+			controller.Stop(methodName)
+			failed = append(failed, methodName)
+			failures = append(failures, err)
+			continue
+		}
+
+		started = append(started, methodName)
+		addrs = append(addrs, addr)
+		proxyUsed = proxy != ""
+	}
+
+	if proxyUsed {
+		pt.ProxyDone()
+	} else if proxyErr != nil {
+		_ = pt.ProxyError(proxyErr.Error())
+	}
+
+	for i, methodName := range started {
+		pt.Cmethod(methodName, "socks5", addrs[i])
+	}
+
+	for i, methodName := range failed {
+		_ = pt.CmethodError(methodName, failures[i].Error())
+	}
+
+	pt.CmethodsDone()
+
+	if len(started) == 0 {
+		os.Exit(1)
+	}
+
+	waitForTermination()
+
+	for _, methodName := range started {
+		controller.Stop(methodName)
+	}
+}
+
+// envError reports a configuration error to tor. goptlib doesn't export its own implementation.
+func envError(msg string) {
+	_, _ = fmt.Fprintf(pt.Stdout, "ENV-ERROR %s\n", strings.ReplaceAll(msg, "\n", " "))
+}
+
+// waitForTermination blocks until tor asks us to quit: By SIGINT, SIGTERM or by closing our stdin, if
+// `TOR_PT_EXIT_ON_STDIN_CLOSE` is set.
+func waitForTermination() {
+	done := make(chan struct{}, 1)
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+
+	go func() {
+		<-signals
+		done <- struct{}{}
+	}()
+
+	if os.Getenv("TOR_PT_EXIT_ON_STDIN_CLOSE") == "1" {
+		go func() {
+			_, _ = io.Copy(io.Discard, os.Stdin)
+			done <- struct{}{}
+		}()
+	}
+
+	<-done
+}
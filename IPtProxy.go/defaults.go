@@ -0,0 +1,235 @@
+package IPtProxy
+
+import (
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strings"
+
+	ptlog "gitlab.torproject.org/tpo/anti-censorship/pluggable-transports/lyrebird/common/log"
+)
+
+// bundledDefaults - The default bridge configurations shipped with IPtProxy, in Tor Browser's pt_config.json format.
+// The obfs4 and meek bridges are taken from Tor Browser's pt_config.json, the Snowflake bridges from the Snowflake
+// release in use.
+//
+//go:embed defaults.json
+var bundledDefaults []byte
+
+// ptConfig - The parts of Tor Browser's pt_config.json we're interested in, plus a version.
+type ptConfig struct {
+	Version string              `json:"version"`
+	Bridges map[string][]string `json:"bridges"`
+}
+
+// defaultBridges - Parsed default configurations.
+type defaultBridges struct {
+	version string
+
+	// lines - Bridge lines by transport name. (pt_config.json uses "meek" for "meek_lite".)
+	lines map[string][]string
+}
+
+// parseDefaults parses a pt_config.json document.
+//
+// @throws if the JSON or a bridge line is invalid.
+func parseDefaults(data []byte) (*defaultBridges, error) {
+	var config ptConfig
+
+	if err := json.Unmarshal(data, &config); err != nil {
+		return nil, err
+	}
+
+	return newDefaultBridges(config.Version, config.Bridges)
+}
+
+// newDefaultBridges sorts the given bridge lines by their transport.
+//
+// @throws if a bridge line is invalid.
+func newDefaultBridges(version string, bridges map[string][]string) (*defaultBridges, error) {
+	d := &defaultBridges{
+		version: version,
+		lines:   make(map[string][]string),
+	}
+
+	for _, lines := range bridges {
+		for _, line := range lines {
+			b, err := parseBridgeLine(line)
+			if err != nil {
+				return nil, err
+			}
+
+			d.lines[b.methodName] = append(d.lines[b.methodName], strings.Join(bridgeLineFields(line), " "))
+		}
+	}
+
+	return d, nil
+}
+
+// bridgeDefaults returns the loaded defaults or the bundled ones.
+func (c *Controller) bridgeDefaults() *defaultBridges {
+	if c.defaults == nil {
+		d, err := parseDefaults(bundledDefaults)
+		if err != nil {
+			// Can only happen with a broken build.
+			ptlog.Errorf("Failed to parse bundled defaults: %s", err.Error())
+
+			d = &defaultBridges{lines: make(map[string][]string)}
+		}
+
+		c.defaults = d
+	}
+
+	return c.defaults
+}
+
+// DefaultsVersion - The version of the default bridge configurations in use.
+//
+// @return the version of the bundled defaults or of the ones loaded with Controller.LoadDefaults.
+func (c *Controller) DefaultsVersion() string {
+	return c.bridgeDefaults().version
+}
+
+// LoadDefaults - Replace the bundled default bridge configurations with newer ones, e.g. fetched by the app.
+// Transports which aren't contained keep their current defaults.
+//
+// @param config A document in the format of Tor Browser's pt_config.json, optionally with a "version" field.
+// Only its "bridges" are used.
+//
+// @throws if the JSON or a bridge line is invalid. The current defaults stay in use then.
+func (c *Controller) LoadDefaults(config string) error {
+	d, err := parseDefaults([]byte(config))
+	if err != nil {
+		ptlog.Errorf("Failed to load defaults: %s", err.Error())
+		return err
+	}
+
+	c.loadDefaults(d)
+
+	return nil
+}
+
+// loadDefaults replaces the defaults of all transports contained in `d`.
+func (c *Controller) loadDefaults(d *defaultBridges) {
+	current := c.bridgeDefaults()
+
+	for methodName, lines := range current.lines {
+		if _, ok := d.lines[methodName]; !ok {
+			d.lines[methodName] = lines
+		}
+	}
+
+	c.defaults = d
+
+	ptlog.Noticef("Loaded defaults version %s", d.version)
+}
+
+// DefaultBridgeLines - The default bridge lines for a transport.
+//
+// @param methodName one of the constants `Obfs4`, `MeekLite`, `Webtunnel` or `Snowflake`.
+//
+// @return newline-separated bridge lines without the leading "Bridge" keyword, ready for Controller.TorrcLines,
+// or an empty string, if there are no defaults for this transport.
+func (c *Controller) DefaultBridgeLines(methodName string) string {
+	return strings.Join(c.bridgeDefaults().lines[methodName], "\n")
+}
+
+// UseDefaults - Configure the Controller fields of a transport from its first default bridge line.
+// Fields are overwritten.
+//
+// With `Snowflake`, this sets `SnowflakeBrokerUrl`, `SnowflakeFrontDomains`, `SnowflakeIceServers`,
+// `SnowflakeAmpCacheUrl`, `SnowflakeSqsUrl` and `SnowflakeSqsCreds`.
+//
+// With `MeekLite`, this sets `MeekUrl` and `MeekFront`, and `MeekFronts` from further default bridges using the
+// same URL.
+//
+// Other transports have no Controller-level settings. Use their DefaultBridgeLines instead.
+//
+// @param methodName `Snowflake` or `MeekLite`.
+//
+// @throws if there are no defaults for this transport, or if it has no Controller-level settings.
+func (c *Controller) UseDefaults(methodName string) error {
+	lines := c.bridgeDefaults().lines[methodName]
+	if len(lines) == 0 {
+		return fmt.Errorf("no defaults for %s", methodName)
+	}
+
+	if err := c.configureFromBridgeLines(methodName, lines); err != nil {
+		return err
+	}
+
+	ptlog.Noticef("Using defaults version %s for %s", c.DefaultsVersion(), methodName)
+
+	return nil
+}
+
+// controllerSettings returns the values of the Controller fields set by Controller.configureFromBridgeLines for
+// the given transport, so changes can be detected.
+func (c *Controller) controllerSettings(methodName string) []string {
+	switch methodName {
+	case Snowflake:
+		return []string{c.SnowflakeBrokerUrl, c.SnowflakeFrontDomains, c.SnowflakeIceServers, c.SnowflakeAmpCacheUrl,
+			c.SnowflakeSqsUrl, c.SnowflakeSqsCreds}
+
+	case MeekLite:
+		return []string{c.MeekUrl, c.MeekFront, c.MeekFronts}
+
+	default:
+		return nil
+	}
+}
+
+// configureFromBridgeLines sets the Controller fields of a transport from the given bridge lines.
+// See Controller.UseDefaults.
+func (c *Controller) configureFromBridgeLines(methodName string, lines []string) error {
+	var bridges []*bridge
+
+	for _, line := range lines {
+		b, err := parseBridgeLine(line)
+		if err != nil {
+			return err
+		}
+
+		bridges = append(bridges, b)
+	}
+
+	args := bridges[0].args
+
+	switch methodName {
+	case Snowflake:
+		fronts, ok := args.Get("fronts")
+		if !ok {
+			fronts, _ = args.Get("front")
+		}
+
+		c.SnowflakeBrokerUrl, _ = args.Get("url")
+		c.SnowflakeFrontDomains = fronts
+		c.SnowflakeIceServers, _ = args.Get("ice")
+		c.SnowflakeAmpCacheUrl, _ = args.Get("ampcache")
+		c.SnowflakeSqsUrl, _ = args.Get("sqsqueue")
+		c.SnowflakeSqsCreds, _ = args.Get("sqscreds")
+
+	case MeekLite:
+		c.MeekUrl, _ = args.Get("url")
+		c.MeekFront, _ = args.Get("front")
+
+		var fronts []string
+
+		for _, b := range bridges[1:] {
+			url, _ := b.args.Get("url")
+			front, _ := b.args.Get("front")
+
+			if url == c.MeekUrl && front != "" && front != c.MeekFront && !slices.Contains(fronts, front) {
+				fronts = append(fronts, front)
+			}
+		}
+
+		c.MeekFronts = strings.Join(fronts, ",")
+
+	default:
+		return fmt.Errorf("%s has no Controller-level settings, use DefaultBridgeLines", methodName)
+	}
+
+	return nil
+}
@@ -0,0 +1,31 @@
+package IPtProxy
+
+import (
+	"testing"
+)
+
+func TestBundledDefaults(t *testing.T) {
+	c := newTestController(t)
+
+	for _, methodName := range []string{Obfs4, MeekLite, Snowflake} {
+		if c.DefaultBridgeLines(methodName) == "" {
+			t.Errorf("no bundled defaults for %s", methodName)
+		}
+	}
+
+	if err := c.UseDefaults(MeekLite); err != nil {
+		t.Fatal(err)
+	}
+
+	if c.MeekUrl == "" || c.MeekFront == "" {
+		t.Errorf("Meek not configured: %s, %s", c.MeekUrl, c.MeekFront)
+	}
+
+	if err := c.UseDefaults(Snowflake); err != nil {
+		t.Fatal(err)
+	}
+
+	if c.SnowflakeBrokerUrl == "" {
+		t.Error("Snowflake not configured")
+	}
+}
@@ -0,0 +1,306 @@
+package IPtProxy
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"regexp"
+	"strings"
+	"sync"
+
+	pt "gitlab.torproject.org/tpo/anti-censorship/pluggable-transports/goptlib"
+	ptlog "gitlab.torproject.org/tpo/anti-censorship/pluggable-transports/lyrebird/common/log"
+	"golang.org/x/net/proxy"
+)
+
+// fingerprintRegex - A relay fingerprint, which is optional in bridge lines.
+var fingerprintRegex = regexp.MustCompile(`^\$?[0-9A-Fa-f]{40}$`)
+
+// errTransportPaused - Returned by Controller.Dial, while the transports are paused.
+var errTransportPaused = errors.New("transport is paused")
+
+// bridge - A parsed bridge line.
+type bridge struct {
+	methodName string
+	address    string
+	args       pt.Args
+}
+
+// bridgeLineFields splits a bridge line into its fields, without the leading "Bridge" keyword, if any.
+func bridgeLineFields(line string) []string {
+	fields := strings.Fields(line)
+
+	if len(fields) > 0 && strings.EqualFold(fields[0], "Bridge") {
+		fields = fields[1:]
+	}
+
+	return fields
+}
+
+// parseBridgeLine parses a bridge line like
+// "obfs4 192.0.2.1:443 0123456789ABCDEF0123456789ABCDEF01234567 cert=... iat-mode=0", with or without the leading
+// "Bridge" keyword.
+//
+// @throws if the line doesn't contain a transport and an address, or if an argument isn't a "key=value" pair.
+func parseBridgeLine(line string) (*bridge, error) {
+	fields := bridgeLineFields(line)
+
+	if len(fields) < 2 {
+		return nil, fmt.Errorf("invalid bridge line \"%s\", expected \"<transport> <address> [fingerprint] [key=value...]\"", line)
+	}
+
+	b := &bridge{
+		methodName: fields[0],
+		address:    fields[1],
+		args:       make(pt.Args),
+	}
+
+	if _, _, err := net.SplitHostPort(b.address); err != nil {
+		return nil, fmt.Errorf("invalid bridge address %s: %w", b.address, err)
+	}
+
+	fields = fields[2:]
+
+	if len(fields) > 0 && fingerprintRegex.MatchString(fields[0]) {
+		fields = fields[1:]
+	}
+
+	for _, field := range fields {
+		key, value, ok := strings.Cut(field, "=")
+		if !ok || key == "" {
+			return nil, fmt.Errorf("invalid bridge argument \"%s\", expected \"key=value\"", field)
+		}
+
+		b.args.Add(key, value)
+	}
+
+	return b, nil
+}
+
+// dialedConn - A connection returned by Controller.Dial. Tracked like the SOCKS connections, so
+// Controller.NetworkChanged and Controller.Stop affect it the same way.
+type dialedConn struct {
+	net.Conn
+	once    sync.Once
+	closed  chan struct{}
+	onClose func()
+}
+
+func (c *dialedConn) Close() error {
+	err := c.Conn.Close()
+
+	c.once.Do(func() {
+		close(c.closed)
+		c.onClose()
+	})
+
+	return err
+}
+
+// Dial - Connect to a bridge through a running transport directly, without the round-trip through its local SOCKS
+// listener. Go API only, use Controller.Connect with gomobile.
+//
+// DNSTT doesn't offer a direct dial, so for DNSTT, this still connects through its SOCKS listener.
+//
+// @param bridgeLine A bridge line like "obfs4 192.0.2.1:443 <fingerprint> cert=... iat-mode=0", with or without the
+// leading "Bridge" keyword. The transport needs to be started with Controller.Start before.
+//
+// @return a connection to the bridge, ready to speak the Tor protocol.
+//
+// @throws if the bridge line is invalid, if the transport is not running or paused, or if the connection failed.
+func (c *Controller) Dial(bridgeLine string) (net.Conn, error) {
+	b, err := parseBridgeLine(bridgeLine)
+	if err != nil {
+		ptlog.Errorf("Failed to dial: %s", err.Error())
+		return nil, err
+	}
+
+	methodName := b.methodName
+
+	c.mutex.Lock()
+	ln, ok := c.listeners[methodName]
+	conns := c.connections[methodName]
+	shutdown := c.shutdown[methodName]
+	paused := c.paused
+	f, hasFactory := c.factories[methodName]
+	extraArgs := c.extraArgs[methodName]
+	p, hasProxy := c.proxies[methodName]
+	c.mutex.Unlock()
+
+	if !ok {
+		ptlog.Errorf("Failed to dial: %s is not running", methodName)
+		return nil, fmt.Errorf("%s is not running", methodName)
+	}
+
+	if paused || (conns != nil && conns.paused.Load()) {
+		ptlog.Errorf("Failed to dial: %s is paused", methodName)
+		return nil, errTransportPaused
+	}
+
+	var remote net.Conn
+
+	if hasFactory {
+		mergeExtraArgs(b.args, extraArgs)
+
+		var args interface{}
+
+		args, err = f.ParseArgs(&b.args)
+		if err != nil {
+			ptlog.Errorf("Error parsing PT args: %s", err.Error())
+
+			if c.transportEvents != nil {
+				go c.transportEvents.Stopped(methodName, err)
+			}
+
+			return nil, err
+		}
+
+		dialFn := proxy.Direct.Dial
+		if hasProxy {
+			dialFn = p.Dial
+		}
+
+		remote, err = f.Dial("tcp", b.address, dialFn, args)
+	} else {
+		remote, err = dialViaSocks(ln.Addr().String(), b)
+	}
+
+	if err != nil {
+		ptlog.Errorf("Error dialing PT: %s", err.Error())
+
+		if c.transportEvents != nil {
+			go c.transportEvents.Stopped(methodName, err)
+		}
+
+		return nil, err
+	}
+
+	conn := &dialedConn{Conn: remote, closed: make(chan struct{})}
+
+	conn.onClose = func() {
+		if conns != nil {
+			conns.remove(conn)
+		}
+
+		if c.transportEvents != nil {
+			ptlog.Noticef("call OnTransportEvents.Stopped")
+			go c.transportEvents.Stopped(methodName, nil)
+		}
+	}
+
+	if conns != nil {
+		conns.add(conn, remote)
+	}
+
+	// Close, when the transport is stopped, like the SOCKS connections.
+	go func() {
+		select {
+		case <-shutdown:
+			_ = conn.Close()
+
+		case <-conn.closed:
+		}
+	}()
+
+	return conn, nil
+}
+
+// dialViaSocks connects through the given local SOCKS listener, passing the bridge arguments as SOCKS
+// username and password, as defined in the pluggable transport specification.
+func dialViaSocks(socksAddr string, b *bridge) (net.Conn, error) {
+	var auth *proxy.Auth
+
+	if len(b.args) > 0 {
+		var pairs []string
+
+		for key, values := range b.args {
+			for _, value := range values {
+				pairs = append(pairs, escapeSocksArg(key)+"="+escapeSocksArg(value))
+			}
+		}
+
+		encoded := strings.Join(pairs, ";")
+
+		auth = &proxy.Auth{User: encoded, Password: "\x00"}
+
+		if len(encoded) > 255 {
+			auth.User = encoded[:255]
+			auth.Password = encoded[255:]
+		}
+	}
+
+	dialer, err := proxy.SOCKS5("tcp", socksAddr, auth, proxy.Direct)
+	if err != nil {
+		return nil, err
+	}
+
+	return dialer.Dial("tcp", b.address)
+}
+
+// escapeSocksArg escapes "\", "=" and ";" with a backslash.
+func escapeSocksArg(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `=`, `\=`, `;`, `\;`).Replace(s)
+}
+
+// TransportConn - A connection through a transport, created by Controller.Connect.
+type TransportConn struct {
+	conn net.Conn
+}
+
+// Connect - Connect to a bridge through a running transport directly, without the round-trip through its local
+// SOCKS listener. gomobile-friendly variant of Controller.Dial.
+//
+// @param bridgeLine A bridge line like "obfs4 192.0.2.1:443 <fingerprint> cert=... iat-mode=0", with or without the
+// leading "Bridge" keyword. The transport needs to be started with Controller.Start before.
+//
+// @return a connection to the bridge, ready to speak the Tor protocol.
+//
+// @throws if the bridge line is invalid, if the transport is not running or paused, or if the connection failed.
+func (c *Controller) Connect(bridgeLine string) (*TransportConn, error) {
+	conn, err := c.Dial(bridgeLine)
+	if err != nil {
+		return nil, err
+	}
+
+	return &TransportConn{conn: conn}, nil
+}
+
+// Read - Read up to `maxBytes` from the connection. Blocks until at least one byte is available.
+//
+// @param maxBytes Maximum number of bytes to read.
+//
+// @return the bytes read.
+//
+// @throws if the connection was closed or failed.
+func (tc *TransportConn) Read(maxBytes int) ([]byte, error) {
+	buf := make([]byte, max(1, maxBytes))
+
+	n, err := tc.conn.Read(buf)
+	if n > 0 {
+		// Deliver the data now, the error will show up on the next read again.
+		return buf[:n], nil
+	}
+
+	if err == nil {
+		err = io.ErrNoProgress
+	}
+
+	return nil, err
+}
+
+// Write - Write data to the connection.
+//
+// @param data The data to write.
+//
+// @return the number of bytes written.
+//
+// @throws if the connection was closed or failed.
+func (tc *TransportConn) Write(data []byte) (int, error) {
+	return tc.conn.Write(data)
+}
+
+// Close - Close the connection.
+func (tc *TransportConn) Close() error {
+	return tc.conn.Close()
+}
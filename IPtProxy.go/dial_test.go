@@ -0,0 +1,175 @@
+package IPtProxy
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	pt "gitlab.torproject.org/tpo/anti-censorship/pluggable-transports/goptlib"
+)
+
+func TestParseBridgeLine(t *testing.T) {
+	tests := []struct {
+		name       string
+		line       string
+		methodName string
+		address    string
+		args       map[string]string
+		fail       bool
+	}{
+		{"obfs4", "obfs4 192.0.2.1:443 0123456789ABCDEF0123456789ABCDEF01234567 cert=abc iat-mode=0", Obfs4,
+			"192.0.2.1:443", map[string]string{"cert": "abc", "iat-mode": "0"}, false},
+		{"keyword", "Bridge obfs4 192.0.2.1:443 cert=abc", Obfs4, "192.0.2.1:443",
+			map[string]string{"cert": "abc"}, false},
+		{"lowercase keyword", "bridge obfs4 192.0.2.1:443", Obfs4, "192.0.2.1:443", nil, false},
+		{"fingerprint with dollar", "obfs4 192.0.2.1:443 $0123456789abcdef0123456789abcdef01234567", Obfs4,
+			"192.0.2.1:443", nil, false},
+		{"value with equals sign", "meek_lite 192.0.2.2:80 url=https://example.com/?a=b", MeekLite,
+			"192.0.2.2:80", map[string]string{"url": "https://example.com/?a=b"}, false},
+		{"ipv6", "webtunnel [2001:db8::1]:443 url=https://example.com/", Webtunnel, "[2001:db8::1]:443",
+			map[string]string{"url": "https://example.com/"}, false},
+		{"empty", "", "", "", nil, true},
+		{"only transport", "Bridge obfs4", "", "", nil, true},
+		{"no port", "obfs4 192.0.2.1 cert=abc", "", "", nil, true},
+		{"argument without value", "obfs4 192.0.2.1:443 cert", "", "", nil, true},
+		{"argument without key", "obfs4 192.0.2.1:443 =abc", "", "", nil, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b, err := parseBridgeLine(tt.line)
+
+			if tt.fail {
+				if err == nil {
+					t.Errorf("parsed %+v, want error", b)
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if b.methodName != tt.methodName || b.address != tt.address {
+				t.Errorf("got %s %s, want %s %s", b.methodName, b.address, tt.methodName, tt.address)
+			}
+
+			if len(b.args) != len(tt.args) {
+				t.Errorf("got args %v, want %v", b.args, tt.args)
+			}
+
+			for key, value := range tt.args {
+				if got, _ := b.args.Get(key); got != value {
+					t.Errorf("got %s=%s, want %s", key, got, value)
+				}
+			}
+		})
+	}
+}
+
+func TestDialViaSocks(t *testing.T) {
+	tests := []struct {
+		name string
+		args map[string]string
+	}{
+		{"no args", nil},
+		{"args", map[string]string{"cert": "abc", "iat-mode": "0"}},
+		{"escaped args", map[string]string{"url": "https://example.com/?a=b;c", "path": `a\b`}},
+		{"args longer than the username", map[string]string{"cert": strings.Repeat("A", 300)}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ln, err := pt.ListenSocks("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer ln.Close()
+
+			requests := make(chan *pt.SocksRequest, 1)
+
+			go func() {
+				conn, err := ln.AcceptSocks()
+				if err != nil {
+					close(requests)
+					return
+				}
+				defer conn.Close()
+
+				requests <- &conn.Req
+				_ = conn.Grant(nil)
+			}()
+
+			b := &bridge{methodName: Obfs4, address: "192.0.2.1:443", args: make(pt.Args)}
+			for key, value := range tt.args {
+				b.args.Add(key, value)
+			}
+
+			conn, err := dialViaSocks(ln.Addr().String(), b)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+
+			req := <-requests
+			if req == nil {
+				t.Fatal("no SOCKS request received")
+			}
+
+			if req.Target != b.address {
+				t.Errorf("target %s, want %s", req.Target, b.address)
+			}
+
+			if len(req.Args) != len(tt.args) {
+				t.Errorf("got args %v, want %v", req.Args, tt.args)
+			}
+
+			for key, value := range tt.args {
+				if got, _ := req.Args.Get(key); got != value {
+					t.Errorf("got %s=%s, want %s", key, got, value)
+				}
+			}
+		})
+	}
+}
+
+func TestDialErrors(t *testing.T) {
+	c := newTestController(t)
+
+	if err := c.Start(Obfs4, ""); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Stop(Obfs4)
+
+	tests := []struct {
+		name   string
+		line   string
+		paused bool
+		err    error
+	}{
+		{"invalid bridge line", "obfs4", false, nil},
+		{"not running", "meek_lite 192.0.2.2:80 url=https://example.com/", false, nil},
+		{"paused", "obfs4 192.0.2.1:443 cert=abc iat-mode=0", true, errTransportPaused},
+		{"invalid arguments", "obfs4 192.0.2.1:443 iat-mode=0", false, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.paused {
+				c.Pause()
+				defer c.Resume()
+			}
+
+			conn, err := c.Dial(tt.line)
+			if err == nil {
+				_ = conn.Close()
+				t.Fatal("dialed, want error")
+			}
+
+			if tt.err != nil && !errors.Is(err, tt.err) {
+				t.Errorf("got %v, want %v", err, tt.err)
+			}
+		})
+	}
+}
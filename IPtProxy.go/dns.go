@@ -0,0 +1,535 @@
+package IPtProxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	ptlog "gitlab.torproject.org/tpo/anti-censorship/pluggable-transports/lyrebird/common/log"
+	"golang.org/x/net/dns/dnsmessage"
+	"golang.org/x/net/proxy"
+)
+
+const (
+	// dnsTimeout - Maximum time to wait for an upstream DNS server to answer.
+	dnsTimeout = 10 * time.Second
+
+	// dnsMinTtl - Answers are cached at least this long, even if the upstream said otherwise.
+	dnsMinTtl = 30 * time.Second
+
+	// dnsMaxTtl - Answers are cached at most this long, even if the upstream said otherwise.
+	dnsMaxTtl = time.Hour
+
+	// dnsMaxCacheEntries - When the cache grows bigger than this, it is flushed.
+	dnsMaxCacheEntries = 1000
+)
+
+// dnsCacheEntry - A cached DNS answer.
+type dnsCacheEntry struct {
+	response []byte
+	expires  time.Time
+}
+
+// dnsResolver - Answers DNS queries from a fixed host map, a cache or an upstream DoH/DoT server.
+type dnsResolver struct {
+	hosts    map[string][]netip.Addr
+	upstream func(ctx context.Context, query []byte) ([]byte, error)
+
+	// resolver - A Go resolver, which sends all its queries to this one. Hand it to the dialers we control.
+	resolver *net.Resolver
+
+	mutex sync.Mutex
+	cache map[string]dnsCacheEntry
+
+	// forward - The dialer to reach the upstream DoH/DoT server with.
+	forward proxy.Dialer
+
+	onFailure func(host string, err error)
+}
+
+// newDnsResolver creates a new resolver.
+//
+// @param server A DoH URL ("https://dns.example/dns-query"), a DoT address ("tls://dns.example:853") or empty
+// to use the system resolver for all names not contained in `hosts`.
+//
+// @param hosts A comma-separated list of "hostname=IP" pairs. A hostname may appear multiple times.
+//
+// @param forward The dialer to reach the DoH/DoT server with.
+func newDnsResolver(server, hosts string, forward proxy.Dialer) (*dnsResolver, error) {
+	r := &dnsResolver{
+		hosts:   make(map[string][]netip.Addr),
+		cache:   make(map[string]dnsCacheEntry),
+		forward: forward,
+	}
+
+	r.resolver = &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			return &dnsConn{ctx: ctx, resolver: r}, nil
+		},
+	}
+
+	for _, pair := range strings.Split(hosts, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+
+		host, ip, ok := strings.Cut(pair, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid DNS host entry %s", pair)
+		}
+
+		addr, err := netip.ParseAddr(strings.TrimSpace(ip))
+		if err != nil {
+			return nil, fmt.Errorf("invalid DNS host entry %s: %w", pair, err)
+		}
+
+		host = canonicalDnsName(host)
+		r.hosts[host] = append(r.hosts[host], addr.Unmap())
+	}
+
+	if server == "" {
+		return r, nil
+	}
+
+	uri, err := url.Parse(server)
+	if err != nil {
+		return nil, fmt.Errorf("invalid DNS server %s: %w", server, err)
+	}
+
+	switch uri.Scheme {
+	case "https":
+		r.upstream = r.newDohUpstream(uri)
+
+	case "tls":
+		r.upstream = r.newDotUpstream(uri)
+
+	default:
+		return nil, fmt.Errorf("unsupported DNS server %s, use https:// (DoH) or tls:// (DoT)", server)
+	}
+
+	return r, nil
+}
+
+// setForward replaces the dialer to reach the upstream DoH/DoT server with.
+func (r *dnsResolver) setForward(forward proxy.Dialer) {
+	r.mutex.Lock()
+	r.forward = forward
+	r.mutex.Unlock()
+}
+
+// bootstrapDial connects to an upstream DNS server, resolving its name via the host map or the system resolver.
+func (r *dnsResolver) bootstrapDial(ctx context.Context, host, port string) (net.Conn, error) {
+	r.mutex.Lock()
+	forward := r.forward
+	r.mutex.Unlock()
+
+	if addrs, ok := r.hosts[canonicalDnsName(host)]; ok && len(addrs) > 0 {
+		host = addrs[0].String()
+	}
+
+	if cd, ok := forward.(proxy.ContextDialer); ok {
+		return cd.DialContext(ctx, "tcp", net.JoinHostPort(host, port))
+	}
+
+	return forward.Dial("tcp", net.JoinHostPort(host, port))
+}
+
+func (r *dnsResolver) newDohUpstream(uri *url.URL) func(ctx context.Context, query []byte) ([]byte, error) {
+	port := uri.Port()
+	if port == "" {
+		port = "443"
+	}
+
+	client := &http.Client{
+		Transport: &http.Transport{
+			Proxy: nil,
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				return r.bootstrapDial(ctx, uri.Hostname(), port)
+			},
+			ForceAttemptHTTP2: true,
+		},
+		Timeout: dnsTimeout,
+	}
+
+	server := uri.String()
+
+	return func(ctx context.Context, query []byte) ([]byte, error) {
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, server, bytes.NewReader(query))
+		if err != nil {
+			return nil, err
+		}
+
+		req.Header.Set("Content-Type", "application/dns-message")
+		req.Header.Set("Accept", "application/dns-message")
+
+		resp, err := client.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("DoH server answered %s", resp.Status)
+		}
+
+		return io.ReadAll(io.LimitReader(resp.Body, 65535))
+	}
+}
+
+func (r *dnsResolver) newDotUpstream(uri *url.URL) func(ctx context.Context, query []byte) ([]byte, error) {
+	port := uri.Port()
+	if port == "" {
+		port = "853"
+	}
+
+	return func(ctx context.Context, query []byte) ([]byte, error) {
+		ctx, cancel := context.WithTimeout(ctx, dnsTimeout)
+		defer cancel()
+
+		rawConn, err := r.bootstrapDial(ctx, uri.Hostname(), port)
+		if err != nil {
+			return nil, err
+		}
+
+		conn := tls.Client(rawConn, &tls.Config{ServerName: uri.Hostname()})
+		defer conn.Close()
+
+		if deadline, ok := ctx.Deadline(); ok {
+			_ = conn.SetDeadline(deadline)
+		}
+
+		if err = conn.HandshakeContext(ctx); err != nil {
+			return nil, err
+		}
+
+		if _, err = conn.Write(binary.BigEndian.AppendUint16(nil, uint16(len(query)))); err != nil {
+			return nil, err
+		}
+		if _, err = conn.Write(query); err != nil {
+			return nil, err
+		}
+
+		length := make([]byte, 2)
+		if _, err = io.ReadFull(conn, length); err != nil {
+			return nil, err
+		}
+
+		response := make([]byte, binary.BigEndian.Uint16(length))
+		if _, err = io.ReadFull(conn, response); err != nil {
+			return nil, err
+		}
+
+		return response, nil
+	}
+}
+
+// flush empties the cache, e.g. after a network change.
+func (r *dnsResolver) flush() {
+	r.mutex.Lock()
+	clear(r.cache)
+	r.mutex.Unlock()
+}
+
+// handle answers a single DNS query message. It always returns a valid response.
+func (r *dnsResolver) handle(ctx context.Context, query []byte) []byte {
+	var parser dnsmessage.Parser
+
+	header, err := parser.Start(query)
+	if err != nil {
+		return nil
+	}
+
+	question, err := parser.Question()
+	if err != nil {
+		return r.reply(header, nil, nil, dnsmessage.RCodeFormatError)
+	}
+
+	name := canonicalDnsName(question.Name.String())
+
+	if addrs, ok := r.hosts[name]; ok && (question.Type == dnsmessage.TypeA || question.Type == dnsmessage.TypeAAAA) {
+		return r.reply(header, &question, filterAddrs(addrs, question.Type), dnsmessage.RCodeSuccess)
+	}
+
+	key := fmt.Sprintf("%s/%d/%d", name, question.Type, question.Class)
+
+	r.mutex.Lock()
+	entry, ok := r.cache[key]
+	r.mutex.Unlock()
+
+	if ok && time.Now().Before(entry.expires) {
+		response := bytes.Clone(entry.response)
+		binary.BigEndian.PutUint16(response, header.ID)
+
+		return response
+	}
+
+	var response []byte
+	var ttl time.Duration
+
+	if r.upstream != nil {
+		response, err = r.upstream(ctx, query)
+		if err == nil {
+			ttl, err = responseTtl(response)
+		}
+	} else {
+		response, err = r.systemLookup(ctx, header, question)
+		ttl = dnsMinTtl
+	}
+
+	if err != nil {
+		ptlog.Warnf("Failed to resolve %s: %s", name, err.Error())
+
+		if r.onFailure != nil {
+			r.onFailure(name, err)
+		}
+
+		return r.reply(header, &question, nil, dnsmessage.RCodeServerFailure)
+	}
+
+	binary.BigEndian.PutUint16(response, header.ID)
+
+	r.mutex.Lock()
+	if len(r.cache) >= dnsMaxCacheEntries {
+		clear(r.cache)
+	}
+	r.cache[key] = dnsCacheEntry{response: bytes.Clone(response), expires: time.Now().Add(ttl)}
+	r.mutex.Unlock()
+
+	return response
+}
+
+// systemLookup resolves A and AAAA queries with the system resolver, if no DoH/DoT server is configured.
+func (r *dnsResolver) systemLookup(ctx context.Context, header dnsmessage.Header,
+	question dnsmessage.Question) ([]byte, error) {
+
+	network := ""
+	switch question.Type {
+	case dnsmessage.TypeA:
+		network = "ip4"
+	case dnsmessage.TypeAAAA:
+		network = "ip6"
+	default:
+		return r.reply(header, &question, nil, dnsmessage.RCodeNotImplemented), nil
+	}
+
+	addrs, err := net.DefaultResolver.LookupNetIP(ctx, network, strings.TrimSuffix(question.Name.String(), "."))
+	if err != nil {
+		var dnsErr *net.DNSError
+		if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+			return r.reply(header, &question, nil, dnsmessage.RCodeNameError), nil
+		}
+
+		return nil, err
+	}
+
+	return r.reply(header, &question, addrs, dnsmessage.RCodeSuccess), nil
+}
+
+// reply builds a response to the given query header and question.
+func (r *dnsResolver) reply(header dnsmessage.Header, question *dnsmessage.Question, addrs []netip.Addr,
+	rcode dnsmessage.RCode) []byte {
+
+	builder := dnsmessage.NewBuilder(nil, dnsmessage.Header{
+		ID:                 header.ID,
+		Response:           true,
+		OpCode:             header.OpCode,
+		RecursionDesired:   header.RecursionDesired,
+		RecursionAvailable: true,
+		RCode:              rcode,
+	})
+	builder.EnableCompression()
+
+	if question == nil {
+		response, _ := builder.Finish()
+		return response
+	}
+
+	_ = builder.StartQuestions()
+	_ = builder.Question(*question)
+	_ = builder.StartAnswers()
+
+	rh := dnsmessage.ResourceHeader{
+		Name:  question.Name,
+		Class: dnsmessage.ClassINET,
+		TTL:   uint32(dnsMinTtl.Seconds()),
+	}
+
+	for _, addr := range addrs {
+		if addr.Is4() {
+			_ = builder.AResource(rh, dnsmessage.AResource{A: addr.As4()})
+		} else {
+			_ = builder.AAAAResource(rh, dnsmessage.AAAAResource{AAAA: addr.As16()})
+		}
+	}
+
+	response, _ := builder.Finish()
+
+	return response
+}
+
+// filterAddrs returns only the IPv4 or IPv6 addresses, depending on the query type.
+func filterAddrs(addrs []netip.Addr, qtype dnsmessage.Type) []netip.Addr {
+	var result []netip.Addr
+
+	for _, addr := range addrs {
+		if addr.Is4() == (qtype == dnsmessage.TypeA) {
+			result = append(result, addr)
+		}
+	}
+
+	return result
+}
+
+// responseTtl returns the smallest TTL of all answers, clamped to `dnsMinTtl` and `dnsMaxTtl`.
+func responseTtl(response []byte) (time.Duration, error) {
+	var parser dnsmessage.Parser
+
+	if _, err := parser.Start(response); err != nil {
+		return 0, err
+	}
+
+	if err := parser.SkipAllQuestions(); err != nil {
+		return 0, err
+	}
+
+	ttl := dnsMaxTtl
+
+	for {
+		header, err := parser.AnswerHeader()
+		if errors.Is(err, dnsmessage.ErrSectionDone) {
+			break
+		}
+		if err != nil {
+			return 0, err
+		}
+
+		ttl = min(ttl, time.Duration(header.TTL)*time.Second)
+
+		if err = parser.SkipAnswer(); err != nil {
+			return 0, err
+		}
+	}
+
+	return max(dnsMinTtl, ttl), nil
+}
+
+func canonicalDnsName(name string) string {
+	return strings.ToLower(strings.TrimSuffix(strings.TrimSpace(name), "."))
+}
+
+// dnsConn - A fake stream connection handed to Go's resolver, which answers its length-prefixed queries locally.
+type dnsConn struct {
+	ctx      context.Context
+	resolver *dnsResolver
+	in       bytes.Buffer
+	out      bytes.Buffer
+}
+
+func (c *dnsConn) Write(b []byte) (int, error) {
+	c.in.Write(b)
+
+	for c.in.Len() >= 2 {
+		length := int(binary.BigEndian.Uint16(c.in.Bytes()))
+		if c.in.Len() < 2+length {
+			break
+		}
+
+		c.in.Next(2)
+		query := bytes.Clone(c.in.Next(length))
+
+		response := c.resolver.handle(c.ctx, query)
+		if response == nil {
+			continue
+		}
+
+		c.out.Write(binary.BigEndian.AppendUint16(nil, uint16(len(response))))
+		c.out.Write(response)
+	}
+
+	return len(b), nil
+}
+
+func (c *dnsConn) Read(b []byte) (int, error) {
+	if c.out.Len() == 0 {
+		return 0, io.EOF
+	}
+
+	return c.out.Read(b)
+}
+
+func (c *dnsConn) Close() error {
+	return nil
+}
+
+func (c *dnsConn) LocalAddr() net.Addr {
+	return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)}
+}
+
+func (c *dnsConn) RemoteAddr() net.Addr {
+	return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 53}
+}
+
+func (c *dnsConn) SetDeadline(time.Time) error {
+	return nil
+}
+
+func (c *dnsConn) SetReadDeadline(time.Time) error {
+	return nil
+}
+
+func (c *dnsConn) SetWriteDeadline(time.Time) error {
+	return nil
+}
+
+// configureDns creates or removes the custom resolver according to `DnsServer` and `DnsHosts`.
+// Transports get it through `outboundDialer`.
+func (c *Controller) configureDns() error {
+	if c.DnsServer == "" && c.DnsHosts == "" {
+		c.dnsResolver = nil
+		c.dnsConfig = ""
+
+		return nil
+	}
+
+	// The upstream server needs to be reached with a protected socket, but must not be resolved with ourselves.
+	forward, err := c.protectedDialer()
+	if err != nil {
+		return err
+	}
+
+	config := c.DnsServer + "\n" + c.DnsHosts
+	if c.dnsResolver != nil && c.dnsConfig == config {
+		c.dnsResolver.setForward(forward)
+
+		return nil
+	}
+
+	r, err := newDnsResolver(c.DnsServer, c.DnsHosts, forward)
+	if err != nil {
+		return err
+	}
+
+	r.onFailure = func(host string, err error) {
+		if c.NetworkEvents != nil {
+			go c.NetworkEvents.ResolutionFailed(host, err)
+		}
+	}
+
+	c.dnsResolver = r
+	c.dnsConfig = config
+
+	return nil
+}
@@ -0,0 +1,50 @@
+package IPtProxy
+
+import (
+	"net"
+	"testing"
+)
+
+func TestDnsHostsOutboundDialer(t *testing.T) {
+	target := startEchoServer(t)
+
+	_, port, err := net.SplitHostPort(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := newTestController(t)
+	c.DnsHosts = "bridge.test=127.0.0.1, other.test=192.0.2.1"
+
+	if err = c.configureDns(); err != nil {
+		t.Fatal(err)
+	}
+
+	dialer, err := c.outboundDialer()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn, err := dialer.Dial("tcp", net.JoinHostPort("Bridge.Test.", port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	assertEcho(t, conn)
+
+	// The resolver of the process stays untouched.
+	if net.DefaultResolver.Dial != nil {
+		t.Error("net.DefaultResolver was modified")
+	}
+
+	c.DnsHosts = ""
+
+	if err = c.configureDns(); err != nil {
+		t.Fatal(err)
+	}
+
+	if c.dnsResolver != nil {
+		t.Error("resolver not removed")
+	}
+}
@@ -1,13 +1,18 @@
 package IPtProxy
 
 import (
-	"log"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
 
 	"time"
 
 	ptlog "gitlab.torproject.org/tpo/anti-censorship/pluggable-transports/lyrebird/common/log"
 	"gitlab.torproject.org/tpo/anti-censorship/pluggable-transports/snowflake/v2/common/covertdtls"
 	"gitlab.torproject.org/tpo/anti-censorship/pluggable-transports/snowflake/v2/common/event"
+	"gitlab.torproject.org/tpo/anti-censorship/pluggable-transports/snowflake/v2/common/namematcher"
 	sfp "gitlab.torproject.org/tpo/anti-censorship/pluggable-transports/snowflake/v2/proxy/lib"
 )
 
@@ -69,7 +74,18 @@ const (
 	NATUnrestricted = sfp.NATUnrestricted
 )
 
+// defaultRelayDomainNamePattern - Only relays of the Tor Project are accepted by default.
+const defaultRelayDomainNamePattern = "snowflake.torproject.net$"
+
 // SnowflakeProxy - Class to start and stop a Snowflake proxy.
+//
+// Only one SnowflakeProxy object can run per process at a time, since the Snowflake proxy library keeps its broker,
+// client slots, WebRTC configuration and NAT type in package-level variables. Starting a second one while another
+// is running fails. Run additional proxies in separate processes.
+//
+// The proxy library cannot stop polling the broker without disconnecting its clients. So, while the proxy is
+// paused, because a data cap was reached, the policy conditions are unmet or outside the schedule, the library is
+// stopped, which disconnects all clients. On resume, it's started again, which also measures the NAT type again.
 type SnowflakeProxy struct {
 
 	// Capacity - the maximum number of clients a Snowflake will serve. If set to 0, the proxy will accept an unlimited number of clients.
@@ -97,9 +113,19 @@ type SnowflakeProxy struct {
 	// If EphemeralMinPort or EphemeralMaxPort is left 0, no limit will be applied.
 	EphemeralMaxPort int
 
-	// StunServer - STUN URL. Defaults to stun:stun.l.google.com:19302, if empty.
+	// StunServer - STUN URL.
+	//
+	// Deprecated: Use `StunServers` instead. Only used, if `StunServers` is empty.
 	StunServer string
 
+	// StunServers - Comma-separated list of STUN URLs. Defaults to
+	// "stun:stun.l.google.com:19302,stun:stun.voip.blackberry.com:3478", if empty.
+	// The servers are health-checked on start and periodically while running. Unreachable ones are left out.
+	// Servers which can't be checked (TCP, TLS or TURN) are used after the reachable ones.
+	// The proxy library can't change its STUN servers while running, so new ones are only selected, when it's
+	// started again, e.g. when the proxy resumes after a pause.
+	StunServers string
+
 	// NatProbeUrl - Defaults to https://snowflake-broker.torproject.net:8443/probe, if empty.
 	NatProbeUrl string
 
@@ -130,17 +156,157 @@ type SnowflakeProxy struct {
 	// Defaults to `CovertDTLSConfigRandomizeMimic`.
 	CovertDTLSConfig string
 
-	isRunning bool
-	proxy     *sfp.SnowflakeProxy
+	// StateDir - Directory, where the proxy persists its data usage, so data caps survive restarts.
+	// If empty, nothing is persisted.
+	StateDir string
+
+	// DailyDataCapMB - Maximum megabytes (1,000,000 bytes) to relay per day, in both directions together.
+	// When reached, all clients are disconnected and the proxy stops polling the broker until the next day.
+	// The proxy library only reports the traffic once a minute, so the cap can be exceeded by up to a minute of
+	// traffic.
+	// If <= 0, no limit will be applied.
+	DailyDataCapMB int
+
+	// MonthlyDataCapMB - Maximum megabytes (1,000,000 bytes) to relay per calendar month, in both directions
+	// together.
+	// When reached, all clients are disconnected and the proxy stops polling the broker until the next month.
+	// The proxy library only reports the traffic once a minute, so the cap can be exceeded by up to a minute of
+	// traffic.
+	// If <= 0, no limit will be applied.
+	MonthlyDataCapMB int
+
+	// LimitEvents - A delegate which is called when a data cap was reached.
+	// Will be called on its own thread! You will need to switch to your own UI thread
+	// if you want to do UI stuff!
+	LimitEvents SnowflakeLimitEvents
+
+	// OnlyUnmetered - Only serve clients while on an unmetered network. Report the network state with
+	// SnowflakeProxy.SetNetworkMetered.
+	OnlyUnmetered bool
+
+	// OnlyWhileCharging - Only serve clients while the device is charging. Report the power state with
+	// SnowflakeProxy.SetCharging.
+	OnlyWhileCharging bool
+
+	// MinBatteryLevel - Only serve clients while the battery level is at least this percentage, or the device is
+	// charging. Report the battery level with SnowflakeProxy.SetBatteryLevel. If <= 0, no limit will be applied.
+	MinBatteryLevel int
+
+	// Schedule - Weekly time windows, in which the proxy polls the broker for new clients. Outside of them, polling
+	// pauses, but existing clients are kept, until they disconnect or `ScheduleGracePeriodMinutes` expire.
+	// The proxy library can't stop polling without disconnecting its clients, so until then, new clients may still
+	// arrive.
+	// Format: Semicolon-separated entries of weekdays and comma-separated time windows, e.g.
+	// "mon-fri 22:00-06:00; sat,sun 00:00-24:00". Weekdays are "mon", "tue", "wed", "thu", "fri", "sat", "sun".
+	// Windows ending before they start continue on the next day.
+	// If empty, the proxy polls all the time.
+	Schedule string
+
+	// ScheduleTimeZone - IANA time zone name, e.g. "Europe/Berlin", in which the `Schedule` is interpreted.
+	// Defaults to the device's local time zone, if empty.
+	ScheduleTimeZone string
+
+	// ScheduleGracePeriodMinutes - Minutes after the end of a `Schedule` window, after which remaining clients
+	// are disconnected. If <= 0, clients are kept until none is left.
+	ScheduleGracePeriodMinutes int
+
+	// KeepLocalAddresses - Send local (private) address candidates to the broker. Only useful for local
+	// deployments and tests. Requires `TestingMode`.
+	KeepLocalAddresses bool
+
+	// RelayDomainNamePattern - Pattern of relay hostnames the proxy accepts from the broker. If the pattern starts
+	// with "^", an exact match is required, otherwise it's a suffix. Must end with "$".
+	// Defaults to "snowflake.torproject.net$", if empty. Change this for private Snowflake deployments.
+	RelayDomainNamePattern string
+
+	// AllowProxyingToPrivateAddresses - Allow forwarding clients to relays on private IP addresses.
+	// Requires `TestingMode`.
+	AllowProxyingToPrivateAddresses bool
+
+	// AllowNonTLSRelay - Allow forwarding clients to relays using unencrypted WebSockets ("ws://").
+	// Requires `TestingMode`.
+	AllowNonTLSRelay bool
+
+	// TestingMode - Allow unsafe options like `KeepLocalAddresses`, `AllowProxyingToPrivateAddresses`,
+	// `AllowNonTLSRelay` and overly broad `RelayDomainNamePattern`s, e.g. for integration tests against a
+	// stand-in broker and relay.
+	// ATTENTION: Never enable this in production!
+	TestingMode bool
+
+	// SessionEvents - A delegate which is called when a client session starts and ends, with the number of clients
+	// served at that time.
+	// Will be called on its own thread! You will need to switch to your own UI thread
+	// if you want to do UI stuff!
+	SessionEvents SnowflakeSessionEvents
+
+	// NatEvents - A delegate which is called when the NAT type was measured, including the STUN server used, and
+	// with the results of SnowflakeProxy.ProbeNAT.
+	// Will be called on its own thread! You will need to switch to your own UI thread
+	// if you want to do UI stuff!
+	NatEvents SnowflakeNatEvents
+
+	// StateEvents - A delegate which is called on state changes of the proxy, including startup failures.
+	// Will be called on its own thread! You will need to switch to your own UI thread
+	// if you want to do UI stuff!
+	StateEvents SnowflakeStateEvents
+
+	stateMutex     sync.Mutex
+	state          string
+	startup        chan struct{}
+	startupErr     error
+	run            *snowflakeRun
+	covertDtlsConf covertdtls.CovertDTLSConfig
+
+	mutex         sync.Mutex
+	pauseReasons  map[string]bool
+	usage         snowflakeUsage
+	capReached    bool
+	usageShutdown chan struct{}
+	statsSummary  snowflakeStatsSummary
+
+	restartPending bool
+
+	policyActive      bool
+	networkMetered    bool
+	charging          bool
+	chargingKnown     bool
+	batteryLevel      int
+	batteryLevelKnown bool
+
+	natType    string
+	natProbing bool
+
+	scheduleShutdown    chan struct{}
+	scheduleWindowEnded time.Time
+
+	stunServersInUse []string
+	activeStunServer string
+	stunShutdown     chan struct{}
+
+	stats       snowflakeLifetimeStats
+	statsLoaded bool
+	uptimeSince time.Time
 }
 
 // Start - Start the Snowflake proxy.
+// Returns immediately. Failures during startup are reported via `StateEvents`. Use SnowflakeProxy.StartAndWait,
+// if you want to block until the proxy is up.
 //
-// @throws if CovertDTLSConfig is invalid.
+// @throws if CovertDTLSConfig, a STUN server or the schedule is invalid, if unsafe relay options are used without
+// `TestingMode`, if the proxy is still stopping (wait for `SnowflakeStateStopped`), or if another SnowflakeProxy
+// object is running in this process.
 func (sp *SnowflakeProxy) Start() error {
-	if sp.isRunning {
+	sp.stateMutex.Lock()
+	defer sp.stateMutex.Unlock()
+
+	switch sp.state {
+	case SnowflakeStateStarting, SnowflakeStateRunning:
 		return nil
+
+	case SnowflakeStateStopping:
+		return errStillStopping
 	}
+
 	if sp.Capacity < 1 {
 		sp.Capacity = 0
 	}
@@ -167,85 +333,185 @@ func (sp *SnowflakeProxy) Start() error {
 		return err
 	}
 
-	eventDispatcher := event.NewSnowflakeEventDispatcher()
-	eventDispatcher.AddSnowflakeEventListener(sp)
-
-	sp.proxy = &sfp.SnowflakeProxy{
-		PollInterval:                    time.Duration(sp.PollInterval) * time.Second,
-		Capacity:                        uint(sp.Capacity),
-		STUNURL:                         sp.StunServer,
-		BrokerURL:                       sp.BrokerUrl,
-		KeepLocalAddresses:              false,
-		RelayURL:                        sp.RelayUrl,
-		EphemeralMinPort:                uint16(sp.EphemeralMinPort),
-		EphemeralMaxPort:                uint16(sp.EphemeralMaxPort),
-		RelayDomainNamePattern:          "snowflake.torproject.net$",
-		AllowProxyingToPrivateAddresses: false,
-		AllowNonTLSRelay:                false,
-		NATProbeURL:                     sp.NatProbeUrl,
-		NATTypeMeasurementInterval:      time.Duration(sp.NATTypeMeasurementInterval),
-		ProxyType:                       sp.ProxyTypeIdentifier,
-		EventDispatcher:                 eventDispatcher,
-		SummaryInterval:                 time.Duration(sp.SummaryInterval) * time.Second,
-		CovertDTLSConfig:                covertDtlsConf,
-	}
-
-	go func() {
-		sp.isRunning = true
-		err := sp.proxy.Start()
+	if sp.RelayDomainNamePattern == "" {
+		sp.RelayDomainNamePattern = defaultRelayDomainNamePattern
+	}
+
+	if err = sp.validateRelayOptions(); err != nil {
+		ptlog.Errorf("Invalid relay options: %s", err.Error())
+		return err
+	}
+
+	if err = sp.validateStunServers(); err != nil {
+		ptlog.Errorf("Invalid STUN servers: %s", err.Error())
+		return err
+	}
+
+	if err = sp.validateSchedule(); err != nil {
+		ptlog.Errorf("Invalid schedule: %s", err.Error())
+		return err
+	}
+
+	// Claim the process-wide Snowflake proxy library first, so no other instance can interfere.
+	if err = claimProxyLibrary(sp); err != nil {
+		ptlog.Errorf("Cannot start Snowflake proxy: %s", err.Error())
+		return err
+	}
+
+	sp.covertDtlsConf = covertDtlsConf
+	sp.startup = make(chan struct{})
+	sp.startupErr = nil
+	sp.setState(SnowflakeStateStarting, nil)
+
+	sp.mutex.Lock()
+	sp.statsSummary = snowflakeStatsSummary{}
+	sp.mutex.Unlock()
+
+	sp.startStats()
+	sp.startUsageTracking()
+	sp.startPolicy()
+	sp.startSchedule()
+	sp.startStunChecks()
+
+	// Starts the proxy library, unless paused right away.
+	sp.updateRunLocked()
+
+	return nil
+}
+
+// validateRelayOptions refuses unsafe relay options, unless `TestingMode` is enabled.
+func (sp *SnowflakeProxy) validateRelayOptions() error {
+	if !namematcher.IsValidRule(sp.RelayDomainNamePattern) {
+		return fmt.Errorf("invalid RelayDomainNamePattern %s, must end with \"$\"", sp.RelayDomainNamePattern)
+	}
+
+	if sp.TestingMode {
+		ptlog.Warnf("Snowflake proxy runs in testing mode, unsafe options are allowed")
+		return nil
+	}
+
+	if sp.KeepLocalAddresses {
+		return errors.New("KeepLocalAddresses requires TestingMode")
+	}
+
+	if sp.AllowProxyingToPrivateAddresses {
+		return errors.New("AllowProxyingToPrivateAddresses requires TestingMode")
+	}
+
+	if sp.AllowNonTLSRelay {
+		return errors.New("AllowNonTLSRelay requires TestingMode")
+	}
+
+	// A pattern without at least a second-level domain would match (nearly) every host.
+	suffix := strings.TrimPrefix(strings.TrimSuffix(sp.RelayDomainNamePattern, "$"), "^")
+	if !strings.Contains(strings.Trim(suffix, "."), ".") {
+		return fmt.Errorf("RelayDomainNamePattern %s is too broad, requires TestingMode", sp.RelayDomainNamePattern)
+	}
+
+	if sp.RelayUrl != "" {
+		relayUrl, err := url.Parse(sp.RelayUrl)
 		if err != nil {
-			sp.isRunning = false
-			eventDispatcher.RemoveSnowflakeEventListener(sp)
-			log.Print(err)
+			return fmt.Errorf("invalid RelayUrl: %w", err)
 		}
-	}()
+
+		if relayUrl.Scheme != "wss" {
+			return errors.New("RelayUrl must use wss://")
+		}
+
+		matcher := namematcher.NewNameMatcher(sp.RelayDomainNamePattern)
+		if !matcher.IsMember(relayUrl.Hostname()) {
+			return fmt.Errorf("RelayUrl %s does not match RelayDomainNamePattern %s", sp.RelayUrl,
+				sp.RelayDomainNamePattern)
+		}
+	}
 
 	return nil
 }
 
 // Stop - Stop the Snowflake proxy.
 func (sp *SnowflakeProxy) Stop() {
-	if sp.isRunning {
-		sp.proxy.Stop()
-		sp.proxy.EventDispatcher.RemoveSnowflakeEventListener(sp)
-		sp.isRunning = false
-		sp.proxy = nil
+	sp.stateMutex.Lock()
+
+	if sp.state != SnowflakeStateStarting && sp.state != SnowflakeStateRunning {
+		sp.stateMutex.Unlock()
+		return
 	}
+
+	sp.setState(SnowflakeStateStopping, nil)
+
+	if sp.run != nil {
+		sp.stopRun()
+	}
+
+	sp.stateMutex.Unlock()
+
+	sp.finishStop(nil)
 }
 
 // IsRunning - Checks to see if a snowflake proxy is running in your app.
+//
+// @return true, while the proxy is starting or running.
 func (sp *SnowflakeProxy) IsRunning() bool {
-	return sp.isRunning
+	state := sp.State()
+
+	return state == SnowflakeStateStarting || state == SnowflakeStateRunning
 }
 
-func (sp *SnowflakeProxy) OnNewSnowflakeEvent(e event.SnowflakeEvent) {
+// onRunEvent handles the events of a run of the proxy library. Clients and traffic of runs, which were stopped
+// already, still count, as they're only disconnected after the run was told to stop.
+func (sp *SnowflakeProxy) onRunEvent(run *snowflakeRun, e event.SnowflakeEvent) {
 	switch ev := e.(type) {
 	case event.EventOnProxyClientConnected:
+		sp.startSession(run)
+
 		if sp.ClientEvents != nil {
 			sp.ClientEvents.Connected()
 		}
 
 	case event.EventOnProxyConnectionOver:
+		sp.recordClientServed(ev.Country)
+		sp.endSession(run, ev.Country)
+
 		if sp.ClientEvents != nil {
 			sp.ClientEvents.Disconnected(ev.Country)
 		}
 
 	case event.EventOnProxyConnectionFailed:
+		sp.recordConnectionFailed()
+
 		if sp.ClientEvents != nil {
 			sp.ClientEvents.ConnectionFailed()
 		}
 
 	case event.EventOnProxyStats:
-		if sp.ClientEvents != nil {
-			sp.ClientEvents.Stats(ev.ConnectionCount, int64(ev.FailedConnectionCount), ev.InboundBytes, ev.OutboundBytes,
-				ev.InboundUnit, ev.OutboundUnit, ev.SummaryInterval.Nanoseconds())
+		sp.addUsage(trafficBytes(ev.InboundBytes, ev.InboundUnit) + trafficBytes(ev.OutboundBytes, ev.OutboundUnit))
+		sp.forwardStats(ev)
+
+		// A stopped run delivers its last traffic with its next statistics. There's nothing more to expect from it.
+		if run.isStopped() {
+			go run.proxy.EventDispatcher.RemoveSnowflakeEventListener(run)
 		}
 
 	case event.EventOnCurrentNATTypeDetermined:
+		// This is the first event after the proxy library finished its startup. It's repeated, whenever the library
+		// measured a different NAT type.
+		run.markStarted()
+
+		if !sp.isCurrentRun(run) {
+			return
+		}
+
+		sp.recordNatType(ev.CurNATType)
+		sp.onRunStarted(run)
+
 		if sp.ClientEvents != nil {
 			sp.ClientEvents.NatTypeUpdated(ev.CurNATType)
 		}
 
+		if sp.NatEvents != nil {
+			go sp.NatEvents.NatTypeDetermined(ev.CurNATType, sp.ActiveStunServer())
+		}
+
 	default:
 	}
 }
@@ -0,0 +1,331 @@
+package IPtProxy
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path"
+	"time"
+
+	ptlog "gitlab.torproject.org/tpo/anti-censorship/pluggable-transports/lyrebird/common/log"
+	"gitlab.torproject.org/tpo/anti-censorship/pluggable-transports/snowflake/v2/common/event"
+)
+
+// SnowflakeUsageFileName - the filename of the persisted data usage residing in `SnowflakeProxy.StateDir`.
+const SnowflakeUsageFileName = "snowflake-usage.json"
+
+//goland:noinspection GoUnusedConst
+const (
+	// CapPeriodDaily - The daily data cap was reached.
+	CapPeriodDaily = "daily"
+
+	// CapPeriodMonthly - The monthly data cap was reached.
+	CapPeriodMonthly = "monthly"
+)
+
+// pauseReasonCap - Polling is paused, because a data cap was reached.
+const pauseReasonCap = "cap"
+
+// libraryStatsInterval - The proxy library only reports the traffic with its periodic statistics. It's told to
+// report them at least this often, to enforce the data caps.
+const libraryStatsInterval = time.Minute
+
+// SnowflakeLimitEvents - Interface to get notified, when a data cap of the Snowflake proxy was reached.
+type SnowflakeLimitEvents interface {
+
+	// CapReached - The daily or monthly data cap was reached. All clients were disconnected and the proxy stopped
+	// polling the broker until the next day or month begins.
+	//
+	// @param period Either `CapPeriodDaily` or `CapPeriodMonthly`.
+	//
+	// @param usedBytes The bytes relayed in that period.
+	CapReached(period string, usedBytes int64)
+}
+
+// snowflakeUsage - Relayed bytes in the current day and month, as persisted to `SnowflakeUsageFileName`.
+type snowflakeUsage struct {
+	Day        string `json:"day"`
+	DayBytes   int64  `json:"dayBytes"`
+	Month      string `json:"month"`
+	MonthBytes int64  `json:"monthBytes"`
+}
+
+// snowflakeStatsSummary - Statistics of the proxy library summed up until `SnowflakeProxy.SummaryInterval` passed.
+type snowflakeStatsSummary struct {
+	connections       int
+	failedConnections int64
+	inboundBytes      int64
+	outboundBytes     int64
+	elapsed           time.Duration
+}
+
+// trafficBytes converts an amount of traffic reported by the proxy library to bytes.
+func trafficBytes(amount int64, unit string) int64 {
+	switch unit {
+	case "KB":
+		return amount * 1000
+
+	case "MB":
+		return amount * 1000 * 1000
+
+	case "GB":
+		return amount * 1000 * 1000 * 1000
+
+	default:
+		return amount
+	}
+}
+
+// forwardStats sums up the statistics of the proxy library, which are reported at least every
+// `libraryStatsInterval`, and hands them to `ClientEvents`, whenever `SummaryInterval` passed.
+func (sp *SnowflakeProxy) forwardStats(ev event.EventOnProxyStats) {
+	if sp.SummaryInterval <= 0 || sp.ClientEvents == nil {
+		return
+	}
+
+	sp.mutex.Lock()
+
+	summary := &sp.statsSummary
+	summary.connections += ev.ConnectionCount
+	summary.failedConnections += int64(ev.FailedConnectionCount)
+	summary.inboundBytes += trafficBytes(ev.InboundBytes, ev.InboundUnit)
+	summary.outboundBytes += trafficBytes(ev.OutboundBytes, ev.OutboundUnit)
+	summary.elapsed += ev.SummaryInterval
+
+	if summary.elapsed < time.Duration(sp.SummaryInterval)*time.Second {
+		sp.mutex.Unlock()
+		return
+	}
+
+	s := *summary
+	*summary = snowflakeStatsSummary{}
+
+	sp.mutex.Unlock()
+
+	sp.ClientEvents.Stats(s.connections, s.failedConnections, s.inboundBytes/1000, s.outboundBytes/1000, "KB", "KB",
+		s.elapsed.Nanoseconds())
+}
+
+// setPollingPaused pauses or resumes polling the broker for the given reason.
+// Polling only happens, when there's no reason left to pause. Pausing stops the proxy library, which disconnects
+// all clients.
+func (sp *SnowflakeProxy) setPollingPaused(reason string, paused bool) {
+	sp.mutex.Lock()
+
+	if sp.pauseReasons == nil {
+		sp.pauseReasons = make(map[string]bool)
+	}
+
+	if paused {
+		sp.pauseReasons[reason] = true
+	} else {
+		delete(sp.pauseReasons, reason)
+	}
+
+	sp.mutex.Unlock()
+
+	// Callers might hold `stateMutex`.
+	go sp.updateRun()
+}
+
+// pollingAllowed checks, if there is no reason to pause polling the broker.
+func (sp *SnowflakeProxy) pollingAllowed() bool {
+	sp.mutex.Lock()
+	defer sp.mutex.Unlock()
+
+	return len(sp.pauseReasons) == 0
+}
+
+// loadUsage reads the persisted data usage from `StateDir`, if any.
+func (sp *SnowflakeProxy) loadUsage() {
+	sp.mutex.Lock()
+	defer sp.mutex.Unlock()
+
+	sp.usage = snowflakeUsage{}
+
+	if sp.StateDir == "" {
+		return
+	}
+
+	data, err := os.ReadFile(path.Join(sp.StateDir, SnowflakeUsageFileName))
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			ptlog.Warnf("Failed to read Snowflake proxy usage: %s", err.Error())
+		}
+
+		return
+	}
+
+	if err = json.Unmarshal(data, &sp.usage); err != nil {
+		ptlog.Warnf("Failed to parse Snowflake proxy usage: %s", err.Error())
+	}
+}
+
+// saveUsage persists the data usage to `StateDir`, if set.
+func (sp *SnowflakeProxy) saveUsage() {
+	if sp.StateDir == "" {
+		return
+	}
+
+	sp.mutex.Lock()
+	data, err := json.Marshal(sp.usage)
+	sp.mutex.Unlock()
+
+	if err != nil {
+		ptlog.Warnf("Failed to encode Snowflake proxy usage: %s", err.Error())
+		return
+	}
+
+	if err = writeFileAtomically(path.Join(sp.StateDir, SnowflakeUsageFileName), data); err != nil {
+		ptlog.Warnf("Failed to write Snowflake proxy usage: %s", err.Error())
+	}
+}
+
+// addUsage adds relayed bytes to the current day and month and checks the caps.
+func (sp *SnowflakeProxy) addUsage(n int64) {
+	sp.mutex.Lock()
+	sp.rollUsage(time.Now())
+	sp.usage.DayBytes += n
+	sp.usage.MonthBytes += n
+	sp.recordBytes(n)
+	sp.mutex.Unlock()
+
+	sp.checkCaps()
+}
+
+// rollUsage resets the counters, when a new day or month began. Needs `mutex` to be held.
+func (sp *SnowflakeProxy) rollUsage(now time.Time) {
+	day := now.Format(time.DateOnly)
+	month := now.Format("2006-01")
+
+	if sp.usage.Day != day {
+		sp.usage.Day = day
+		sp.usage.DayBytes = 0
+	}
+
+	if sp.usage.Month != month {
+		sp.usage.Month = month
+		sp.usage.MonthBytes = 0
+	}
+}
+
+// checkCaps pauses polling, when a data cap is reached, and resumes polling again, when a new day or month began.
+func (sp *SnowflakeProxy) checkCaps() {
+	sp.mutex.Lock()
+
+	sp.rollUsage(time.Now())
+
+	period := ""
+	used := int64(0)
+
+	if sp.DailyDataCapMB > 0 && sp.usage.DayBytes >= int64(sp.DailyDataCapMB)*1000*1000 {
+		period = CapPeriodDaily
+		used = sp.usage.DayBytes
+	} else if sp.MonthlyDataCapMB > 0 && sp.usage.MonthBytes >= int64(sp.MonthlyDataCapMB)*1000*1000 {
+		period = CapPeriodMonthly
+		used = sp.usage.MonthBytes
+	}
+
+	wasReached := sp.capReached
+	sp.capReached = period != ""
+
+	sp.mutex.Unlock()
+
+	if period == "" {
+		if wasReached {
+			ptlog.Noticef("Snowflake proxy data cap period renewed, resuming")
+			sp.setPollingPaused(pauseReasonCap, false)
+		}
+
+		return
+	}
+
+	if wasReached {
+		return
+	}
+
+	ptlog.Noticef("Snowflake proxy %s data cap reached, pausing", period)
+
+	sp.setPollingPaused(pauseReasonCap, true)
+	sp.saveUsage()
+
+	if sp.LimitEvents != nil {
+		go sp.LimitEvents.CapReached(period, used)
+	}
+}
+
+// startUsageTracking loads the persisted usage and periodically checks the caps and saves the usage and the
+// lifetime statistics.
+func (sp *SnowflakeProxy) startUsageTracking() {
+	sp.loadUsage()
+
+	sp.mutex.Lock()
+	sp.capReached = false
+	sp.usageShutdown = make(chan struct{})
+	shutdown := sp.usageShutdown
+	sp.mutex.Unlock()
+
+	sp.checkCaps()
+
+	go func() {
+		ticker := time.NewTicker(time.Minute)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-shutdown:
+				return
+
+			case <-ticker.C:
+				sp.checkCaps()
+				sp.saveUsage()
+				sp.saveStats()
+			}
+		}
+	}()
+}
+
+// stopUsageTracking stops the periodic saving and persists the usage a last time.
+func (sp *SnowflakeProxy) stopUsageTracking() {
+	sp.mutex.Lock()
+	if sp.usageShutdown != nil {
+		close(sp.usageShutdown)
+		sp.usageShutdown = nil
+	}
+	sp.mutex.Unlock()
+
+	sp.setPollingPaused(pauseReasonCap, false)
+
+	sp.saveUsage()
+}
+
+// UsedBytesToday - Bytes relayed by the Snowflake proxy today.
+func (sp *SnowflakeProxy) UsedBytesToday() int64 {
+	sp.mutex.Lock()
+	defer sp.mutex.Unlock()
+
+	sp.rollUsage(time.Now())
+
+	return sp.usage.DayBytes
+}
+
+// UsedBytesThisMonth - Bytes relayed by the Snowflake proxy this month.
+func (sp *SnowflakeProxy) UsedBytesThisMonth() int64 {
+	sp.mutex.Lock()
+	defer sp.mutex.Unlock()
+
+	sp.rollUsage(time.Now())
+
+	return sp.usage.MonthBytes
+}
+
+// writeFileAtomically writes to a temporary file first and then renames it, so readers never see a partial file.
+func writeFileAtomically(name string, data []byte) error {
+	tempFile := name + ".tmp"
+
+	if err := os.WriteFile(tempFile, data, 0600); err != nil {
+		return err
+	}
+
+	return os.Rename(tempFile, name)
+}
@@ -0,0 +1,201 @@
+package IPtProxy
+
+import (
+	"encoding/json"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"gitlab.torproject.org/tpo/anti-censorship/pluggable-transports/snowflake/v2/common/event"
+)
+
+type testLimitEvents struct {
+	capReached chan string
+}
+
+func (e *testLimitEvents) CapReached(period string, _ int64) {
+	e.capReached <- period
+}
+
+type testClientEvents struct {
+	stats chan [4]int64
+}
+
+func (e *testClientEvents) Connected()          {}
+func (e *testClientEvents) Disconnected(string) {}
+func (e *testClientEvents) ConnectionFailed()   {}
+
+func (e *testClientEvents) Stats(connectionCount int, failedConnectionCount int64, inboundBytes, outboundBytes int64,
+	_, _ string, _ int64) {
+
+	e.stats <- [4]int64{int64(connectionCount), failedConnectionCount, inboundBytes, outboundBytes}
+}
+
+func (e *testClientEvents) NatTypeUpdated(string) {}
+
+func TestTrafficBytes(t *testing.T) {
+	tests := []struct {
+		amount int64
+		unit   string
+		bytes  int64
+	}{
+		{12, "B", 12},
+		{12, "KB", 12000},
+		{12, "MB", 12000000},
+		{2, "GB", 2000000000},
+	}
+
+	for _, tt := range tests {
+		if got := trafficBytes(tt.amount, tt.unit); got != tt.bytes {
+			t.Errorf("trafficBytes(%d, %s) = %d, want %d", tt.amount, tt.unit, got, tt.bytes)
+		}
+	}
+}
+
+func TestDataCaps(t *testing.T) {
+	const mb = 1000 * 1000
+
+	tests := []struct {
+		name       string
+		dailyCap   int
+		monthlyCap int
+		used       []int64
+		period     string
+	}{
+		{"no caps", 0, 0, []int64{500 * mb}, ""},
+		{"below daily cap", 10, 0, []int64{4 * mb, 5 * mb}, ""},
+		{"daily cap", 10, 0, []int64{4 * mb, 6 * mb}, CapPeriodDaily},
+		{"monthly cap", 0, 10, []int64{10 * mb}, CapPeriodMonthly},
+		{"daily before monthly", 10, 10, []int64{11 * mb}, CapPeriodDaily},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			events := &testLimitEvents{capReached: make(chan string, 1)}
+
+			sp := &SnowflakeProxy{
+				DailyDataCapMB:   tt.dailyCap,
+				MonthlyDataCapMB: tt.monthlyCap,
+				LimitEvents:      events,
+			}
+			sp.startUsageTracking()
+			defer sp.stopUsageTracking()
+
+			var total int64
+			for _, n := range tt.used {
+				sp.addUsage(n)
+				total += n
+			}
+
+			if sp.UsedBytesToday() != total || sp.UsedBytesThisMonth() != total {
+				t.Errorf("used %d today and %d this month, want %d", sp.UsedBytesToday(), sp.UsedBytesThisMonth(),
+					total)
+			}
+
+			if sp.pollingAllowed() != (tt.period == "") {
+				t.Errorf("polling allowed: %v, want %v", sp.pollingAllowed(), tt.period == "")
+			}
+
+			select {
+			case period := <-events.capReached:
+				if period != tt.period {
+					t.Errorf("cap reached for %s, want %s", period, tt.period)
+				}
+
+			case <-time.After(100 * time.Millisecond):
+				if tt.period != "" {
+					t.Errorf("cap not reached, want %s", tt.period)
+				}
+			}
+		})
+	}
+}
+
+func TestUsagePersistence(t *testing.T) {
+	now := time.Now()
+
+	tests := []struct {
+		name       string
+		stored     snowflakeUsage
+		wantDay    int64
+		wantMonth  int64
+		wantPaused bool
+	}{
+		{"same day", snowflakeUsage{now.Format(time.DateOnly), 3000, now.Format("2006-01"), 5000}, 3000, 5000, false},
+		{"cap reached before restart", snowflakeUsage{now.Format(time.DateOnly), 2000000, now.Format("2006-01"),
+			2000000}, 2000000, 2000000, true},
+		{"previous day", snowflakeUsage{"2000-01-01", 3000, now.Format("2006-01"), 5000}, 0, 5000, false},
+		{"previous month", snowflakeUsage{"2000-01-01", 3000, "2000-01", 5000}, 0, 0, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+
+			data, err := json.Marshal(tt.stored)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if err = os.WriteFile(path.Join(dir, SnowflakeUsageFileName), data, 0600); err != nil {
+				t.Fatal(err)
+			}
+
+			sp := &SnowflakeProxy{StateDir: dir, DailyDataCapMB: 1}
+			sp.startUsageTracking()
+
+			if sp.UsedBytesToday() != tt.wantDay || sp.UsedBytesThisMonth() != tt.wantMonth {
+				t.Errorf("loaded %d today and %d this month, want %d and %d", sp.UsedBytesToday(),
+					sp.UsedBytesThisMonth(), tt.wantDay, tt.wantMonth)
+			}
+
+			if sp.pollingAllowed() == tt.wantPaused {
+				t.Errorf("polling allowed: %v, want %v", sp.pollingAllowed(), !tt.wantPaused)
+			}
+
+			sp.addUsage(100)
+			sp.stopUsageTracking()
+
+			sp2 := &SnowflakeProxy{StateDir: dir}
+			sp2.loadUsage()
+
+			if sp2.UsedBytesToday() != tt.wantDay+100 || sp2.UsedBytesThisMonth() != tt.wantMonth+100 {
+				t.Errorf("persisted %d today and %d this month, want %d and %d", sp2.UsedBytesToday(),
+					sp2.UsedBytesThisMonth(), tt.wantDay+100, tt.wantMonth+100)
+			}
+		})
+	}
+}
+
+func TestForwardStats(t *testing.T) {
+	events := &testClientEvents{stats: make(chan [4]int64, 2)}
+
+	sp := &SnowflakeProxy{SummaryInterval: 120, ClientEvents: events}
+
+	ev := event.EventOnProxyStats{
+		SummaryInterval:       libraryStatsInterval,
+		ConnectionCount:       2,
+		FailedConnectionCount: 1,
+		InboundBytes:          10,
+		OutboundBytes:         20,
+		InboundUnit:           "KB",
+		OutboundUnit:          "KB",
+	}
+
+	sp.forwardStats(ev)
+
+	if len(events.stats) != 0 {
+		t.Fatal("statistics forwarded before the summary interval passed")
+	}
+
+	sp.forwardStats(ev)
+
+	if len(events.stats) != 1 {
+		t.Fatal("statistics not forwarded after the summary interval passed")
+	}
+
+	if got, want := <-events.stats, [4]int64{4, 2, 20, 40}; got != want {
+		t.Errorf("forwarded %v, want %v", got, want)
+	}
+}
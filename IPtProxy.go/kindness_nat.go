@@ -0,0 +1,218 @@
+package IPtProxy
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/pion/ice/v4"
+	"github.com/pion/webrtc/v4"
+	ptlog "gitlab.torproject.org/tpo/anti-censorship/pluggable-transports/lyrebird/common/log"
+	"gitlab.torproject.org/tpo/anti-censorship/pluggable-transports/snowflake/v2/common/covertdtls"
+	"gitlab.torproject.org/tpo/anti-censorship/pluggable-transports/snowflake/v2/common/messages"
+	"gitlab.torproject.org/tpo/anti-censorship/pluggable-transports/snowflake/v2/common/util"
+	sfp "gitlab.torproject.org/tpo/anti-censorship/pluggable-transports/snowflake/v2/proxy/lib"
+)
+
+// natProbeTimeout - Time to wait for the probe server to open a data channel, same as the proxy library uses.
+// If it doesn't, our NAT is restricted.
+const natProbeTimeout = 20 * time.Second
+
+// natProbeReadLimit - Maximum size of the probe server's answer.
+const natProbeReadLimit = 100000
+
+// ProbeNAT - Trigger a fresh NAT type measurement against the NAT probe server immediately, e.g. after the
+// device switched networks. Returns immediately, the result is reported via
+// SnowflakeNatEvents.NatProbeFinished. If a probe is already in progress, no additional one is started.
+//
+// The proxy library measures the NAT type on its own, and announces that to the broker. It cannot be told about
+// our result. So, if the proxy is running and the NAT type changed, the library is started again, so it picks up the
+// change. That disconnects all clients, so it's postponed until no client is served anymore.
+func (sp *SnowflakeProxy) ProbeNAT() {
+	sp.mutex.Lock()
+	if sp.natProbing {
+		sp.mutex.Unlock()
+		return
+	}
+	sp.natProbing = true
+	sp.mutex.Unlock()
+
+	go func() {
+		natType, duration, probeUrl, stunServer, err := sp.probeNat()
+
+		sp.mutex.Lock()
+		sp.natProbing = false
+		previous := sp.natType
+		sp.mutex.Unlock()
+
+		if err != nil {
+			ptlog.Warnf("NAT probe failed: %s", err.Error())
+		} else {
+			ptlog.Noticef("NAT probe: %s -> %s", previous, natType)
+		}
+
+		if sp.NatEvents != nil {
+			go sp.NatEvents.NatProbeFinished(natType, duration.Milliseconds(), probeUrl, stunServer, err)
+		}
+
+		if err == nil && natType != previous {
+			sp.restartRunWhenIdle()
+		}
+	}()
+}
+
+// probeNat measures the NAT type the same way the proxy library does: We offer a WebRTC connection to the probe
+// server, which sits behind a symmetric NAT. If it can connect to us, our NAT is unrestricted.
+func (sp *SnowflakeProxy) probeNat() (natType string, duration time.Duration, probeUrl, stunServer string,
+	err error) {
+
+	start := time.Now()
+	natType = NATUnknown
+
+	probeUrl = sp.NatProbeUrl
+	if probeUrl == "" {
+		probeUrl = sfp.DefaultNATProbeURL
+	}
+
+	sp.mutex.Lock()
+	servers := sp.stunServersInUse
+	stunServer = sp.activeStunServer
+	sp.mutex.Unlock()
+
+	if len(servers) == 0 {
+		servers = sp.selectStunServers()
+		stunServer = servers[0]
+	}
+
+	defer func() {
+		duration = time.Since(start)
+	}()
+
+	api, err := sp.natProbeApi()
+	if err != nil {
+		return
+	}
+
+	pc, err := api.NewPeerConnection(webrtc.Configuration{
+		ICEServers: []webrtc.ICEServer{{URLs: servers}},
+	})
+	if err != nil {
+		return
+	}
+	defer pc.Close()
+
+	opened := make(chan struct{})
+
+	dc, err := pc.CreateDataChannel("test", &webrtc.DataChannelInit{})
+	if err != nil {
+		return
+	}
+
+	dc.OnOpen(func() {
+		close(opened)
+	})
+
+	offer, err := pc.CreateOffer(nil)
+	if err != nil {
+		return
+	}
+
+	gathered := webrtc.GatheringCompletePromise(pc)
+
+	if err = pc.SetLocalDescription(offer); err != nil {
+		return
+	}
+
+	<-gathered
+
+	sdp, err := util.SerializeSessionDescription(pc.LocalDescription())
+	if err != nil {
+		return
+	}
+
+	body, err := (&messages.ProxyPollResponse{Status: messages.ProxyClientMatch, Offer: sdp}).Encode()
+	if err != nil {
+		return
+	}
+
+	client := &http.Client{Timeout: natProbeTimeout}
+
+	resp, err := client.Post(probeUrl, "", bytes.NewReader(body))
+	if err != nil {
+		return
+	}
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, natProbeReadLimit))
+	_ = resp.Body.Close()
+	if err != nil {
+		return
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		err = fmt.Errorf("probe server returned status code %d", resp.StatusCode)
+		return
+	}
+
+	req, err := messages.DecodeProxyAnswerRequest(data)
+	if err != nil {
+		return
+	}
+
+	answer, err := util.DeserializeSessionDescription(req.Answer)
+	if err != nil {
+		return
+	}
+
+	if err = pc.SetRemoteDescription(*answer); err != nil {
+		return
+	}
+
+	select {
+	case <-opened:
+		natType = NATUnrestricted
+
+	case <-time.After(natProbeTimeout):
+		natType = NATRestricted
+	}
+
+	return
+}
+
+// natProbeApi creates a WebRTC API configured like the one of the proxy library.
+func (sp *SnowflakeProxy) natProbeApi() (*webrtc.API, error) {
+	settingsEngine := webrtc.SettingEngine{}
+
+	if !sp.KeepLocalAddresses {
+		settingsEngine.SetIPFilter(func(ip net.IP) bool {
+			return !util.IsLocal(ip) && !ip.IsLoopback() && !ip.IsUnspecified()
+		})
+	}
+	settingsEngine.SetIncludeLoopbackCandidate(sp.KeepLocalAddresses)
+
+	if sp.EphemeralMinPort != 0 && sp.EphemeralMaxPort != 0 {
+		err := settingsEngine.SetEphemeralUDPPortRange(uint16(sp.EphemeralMinPort), uint16(sp.EphemeralMaxPort))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	settingsEngine.SetICEMulticastDNSMode(ice.MulticastDNSModeDisabled)
+	settingsEngine.SetDTLSInsecureSkipHelloVerify(true)
+
+	covertDtlsConfig := sp.CovertDTLSConfig
+	if covertDtlsConfig == "" {
+		covertDtlsConfig = CovertDTLSConfigRandomizeMimic
+	}
+
+	covertDtlsConf, err := covertdtls.ParseCovertDTLSConfigString(covertDtlsConfig)
+	if err == nil && (covertDtlsConf.Mimic || covertDtlsConf.Randomize || len(covertDtlsConf.Fingerprint) > 0) {
+		if err = covertdtls.SetCovertDTLSSettings(&covertDtlsConf, &settingsEngine); err != nil {
+			return nil, err
+		}
+	}
+
+	return webrtc.NewAPI(webrtc.WithSettingEngine(settingsEngine)), nil
+}
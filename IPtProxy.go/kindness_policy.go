@@ -0,0 +1,136 @@
+package IPtProxy
+
+import (
+	ptlog "gitlab.torproject.org/tpo/anti-censorship/pluggable-transports/lyrebird/common/log"
+)
+
+// pauseReasonPolicy - Polling is paused, because the platform conditions don't meet the policy.
+const pauseReasonPolicy = "policy"
+
+// SetNetworkMetered - Report, if the device currently uses a metered network (e.g. cellular).
+// Call this on every connectivity change. Assumed to be unmetered, until reported otherwise.
+// While the proxy is running and the network switched between metered and unmetered, this also triggers
+// SnowflakeProxy.ProbeNAT, as the NAT type might have changed with the network.
+//
+// @param metered true, if the current network is metered.
+func (sp *SnowflakeProxy) SetNetworkMetered(metered bool) {
+	sp.mutex.Lock()
+	changed := sp.networkMetered != metered
+	sp.networkMetered = metered
+	active := sp.policyActive
+	sp.mutex.Unlock()
+
+	sp.applyPolicy()
+
+	if active && changed {
+		sp.ProbeNAT()
+	}
+}
+
+// SetCharging - Report, if the device is currently charging.
+// Call this on every power change. Assumed to be not charging, until reported otherwise.
+//
+// @param charging true, if the device is connected to power.
+func (sp *SnowflakeProxy) SetCharging(charging bool) {
+	sp.mutex.Lock()
+	sp.charging = charging
+	sp.chargingKnown = true
+	sp.mutex.Unlock()
+
+	sp.applyPolicy()
+}
+
+// SetBatteryLevel - Report the current battery level.
+// Call this on battery level changes. Assumed to be unknown, until reported.
+//
+// @param level The battery level in percent (0 - 100).
+func (sp *SnowflakeProxy) SetBatteryLevel(level int) {
+	sp.mutex.Lock()
+	sp.batteryLevel = max(0, min(100, level))
+	sp.batteryLevelKnown = true
+	sp.mutex.Unlock()
+
+	sp.applyPolicy()
+}
+
+// PolicyConditionsMet - Checks, if the current platform conditions meet the rules `OnlyUnmetered`,
+// `OnlyWhileCharging` and `MinBatteryLevel`.
+//
+// @return true, if the proxy is allowed to serve clients.
+func (sp *SnowflakeProxy) PolicyConditionsMet() bool {
+	sp.mutex.Lock()
+	defer sp.mutex.Unlock()
+
+	return sp.policyConditionsMet()
+}
+
+// policyConditionsMet needs `mutex` to be held.
+func (sp *SnowflakeProxy) policyConditionsMet() bool {
+	if sp.OnlyUnmetered && sp.networkMetered {
+		return false
+	}
+
+	if sp.OnlyWhileCharging && (!sp.chargingKnown || !sp.charging) {
+		return false
+	}
+
+	// Being connected to power overrides a low battery level.
+	if sp.MinBatteryLevel > 0 && !(sp.chargingKnown && sp.charging) &&
+		(!sp.batteryLevelKnown || sp.batteryLevel < sp.MinBatteryLevel) {
+
+		return false
+	}
+
+	return true
+}
+
+// startPolicy starts applying the policy.
+func (sp *SnowflakeProxy) startPolicy() {
+	sp.mutex.Lock()
+	sp.policyActive = true
+	met := sp.policyConditionsMet()
+	sp.mutex.Unlock()
+
+	sp.setPollingPaused(pauseReasonPolicy, !met)
+
+	if !met {
+		ptlog.Noticef("Snowflake proxy policy conditions unmet, pausing")
+	}
+}
+
+// stopPolicy stops applying the policy.
+func (sp *SnowflakeProxy) stopPolicy() {
+	sp.mutex.Lock()
+	sp.policyActive = false
+	sp.mutex.Unlock()
+
+	sp.setPollingPaused(pauseReasonPolicy, false)
+}
+
+// applyPolicy pauses polling and disconnects all clients, when the conditions are unmet, and resumes polling, when
+// they're met again. Only has an effect while the proxy is running.
+func (sp *SnowflakeProxy) applyPolicy() {
+	sp.mutex.Lock()
+
+	if !sp.policyActive {
+		sp.mutex.Unlock()
+		return
+	}
+
+	met := sp.policyConditionsMet()
+	wasPaused := sp.pauseReasons[pauseReasonPolicy]
+
+	sp.mutex.Unlock()
+
+	if met == !wasPaused {
+		return
+	}
+
+	sp.setPollingPaused(pauseReasonPolicy, !met)
+
+	if met {
+		ptlog.Noticef("Snowflake proxy policy conditions met, resuming")
+	} else {
+		ptlog.Noticef("Snowflake proxy policy conditions unmet, pausing")
+	}
+}
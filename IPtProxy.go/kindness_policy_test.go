@@ -0,0 +1,122 @@
+package IPtProxy
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestPolicyConditions(t *testing.T) {
+	type conditions struct {
+		metered      bool
+		charging     *bool
+		batteryLevel *int
+	}
+
+	yes, no := true, false
+	low, high := 10, 80
+
+	tests := []struct {
+		name              string
+		onlyUnmetered     bool
+		onlyWhileCharging bool
+		minBatteryLevel   int
+		conditions        conditions
+		met               bool
+	}{
+		{"no rules", false, false, 0, conditions{true, nil, nil}, true},
+		{"unmetered", true, false, 0, conditions{false, nil, nil}, true},
+		{"metered", true, false, 0, conditions{true, nil, nil}, false},
+		{"charging unknown", false, true, 0, conditions{false, nil, nil}, false},
+		{"charging", false, true, 0, conditions{false, &yes, nil}, true},
+		{"not charging", false, true, 0, conditions{false, &no, nil}, false},
+		{"battery unknown", false, false, 50, conditions{false, nil, nil}, false},
+		{"battery high", false, false, 50, conditions{false, nil, &high}, true},
+		{"battery low", false, false, 50, conditions{false, &no, &low}, false},
+		{"battery low but charging", false, false, 50, conditions{false, &yes, &low}, true},
+		{"all met", true, true, 50, conditions{false, &yes, &low}, true},
+		{"all but network met", true, true, 50, conditions{true, &yes, &high}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sp := &SnowflakeProxy{
+				OnlyUnmetered:     tt.onlyUnmetered,
+				OnlyWhileCharging: tt.onlyWhileCharging,
+				MinBatteryLevel:   tt.minBatteryLevel,
+			}
+
+			sp.SetNetworkMetered(tt.conditions.metered)
+
+			if tt.conditions.charging != nil {
+				sp.SetCharging(*tt.conditions.charging)
+			}
+
+			if tt.conditions.batteryLevel != nil {
+				sp.SetBatteryLevel(*tt.conditions.batteryLevel)
+			}
+
+			if sp.PolicyConditionsMet() != tt.met {
+				t.Errorf("conditions met: %v, want %v", sp.PolicyConditionsMet(), tt.met)
+			}
+		})
+	}
+}
+
+func TestPolicyPausesPolling(t *testing.T) {
+	sp := &SnowflakeProxy{OnlyWhileCharging: true}
+	sp.startPolicy()
+	defer sp.stopPolicy()
+
+	steps := []struct {
+		charging bool
+		allowed  bool
+	}{
+		{false, false},
+		{true, true},
+		{false, false},
+		{false, false},
+		{true, true},
+	}
+
+	for i, step := range steps {
+		sp.SetCharging(step.charging)
+
+		if sp.pollingAllowed() != step.allowed {
+			t.Errorf("step %d: polling allowed: %v, want %v", i, sp.pollingAllowed(), step.allowed)
+		}
+	}
+}
+
+func TestPausedStart(t *testing.T) {
+	sp := &SnowflakeProxy{OnlyWhileCharging: true, StunServers: "stun:127.0.0.1:3478"}
+
+	// Polling is paused right away, so the proxy library isn't started at all.
+	if err := sp.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	if sp.State() != SnowflakeStateRunning {
+		t.Errorf("state %s, want %s", sp.State(), SnowflakeStateRunning)
+	}
+
+	if sp.ActiveSessions() != 0 {
+		t.Errorf("%d active sessions, want 0", sp.ActiveSessions())
+	}
+
+	other := &SnowflakeProxy{}
+	if err := other.Start(); !errors.Is(err, errAnotherProxyRunning) {
+		t.Errorf("second proxy started with %v, want %v", err, errAnotherProxyRunning)
+	}
+
+	sp.Stop()
+
+	if sp.State() != SnowflakeStateStopped {
+		t.Errorf("state %s, want %s", sp.State(), SnowflakeStateStopped)
+	}
+
+	if err := claimProxyLibrary(other); err != nil {
+		t.Errorf("proxy library not released: %s", err)
+	}
+
+	releaseProxyLibrary(other)
+}
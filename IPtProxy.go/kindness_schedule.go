@@ -0,0 +1,316 @@
+package IPtProxy
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	ptlog "gitlab.torproject.org/tpo/anti-censorship/pluggable-transports/lyrebird/common/log"
+)
+
+// pauseReasonSchedule - Polling is paused, because we're outside the schedule.
+const pauseReasonSchedule = "schedule"
+
+// scheduleCheckInterval - How often the schedule is checked.
+const scheduleCheckInterval = 30 * time.Second
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+// scheduleWindow - A time window on a weekday, in minutes since midnight. `end` is exclusive.
+type scheduleWindow struct {
+	weekday time.Weekday
+	start   int
+	end     int
+}
+
+// schedule - Parsed `SnowflakeProxy.Schedule`.
+type schedule struct {
+	windows  []scheduleWindow
+	location *time.Location
+}
+
+// parseSchedule parses a schedule like "mon-fri 22:00-06:00; sat,sun 00:00-24:00".
+// Windows ending before they start continue on the next day.
+//
+// @throws if the schedule or the time zone is invalid.
+func parseSchedule(text, timeZone string) (*schedule, error) {
+	s := &schedule{location: time.Local}
+
+	if timeZone != "" {
+		location, err := time.LoadLocation(timeZone)
+		if err != nil {
+			return nil, fmt.Errorf("invalid time zone %s: %w", timeZone, err)
+		}
+
+		s.location = location
+	}
+
+	for _, entry := range strings.Split(text, ";") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		fields := strings.Fields(entry)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("invalid schedule entry \"%s\", expected \"<days> <times>\"", entry)
+		}
+
+		days, err := parseWeekdays(fields[0])
+		if err != nil {
+			return nil, err
+		}
+
+		for _, window := range strings.Split(fields[1], ",") {
+			start, end, err := parseTimeWindow(window)
+			if err != nil {
+				return nil, err
+			}
+
+			for _, day := range days {
+				if end > start {
+					s.windows = append(s.windows, scheduleWindow{day, start, end})
+				} else {
+					// Overnight window.
+					s.windows = append(s.windows, scheduleWindow{day, start, 24 * 60})
+					s.windows = append(s.windows, scheduleWindow{(day + 1) % 7, 0, end})
+				}
+			}
+		}
+	}
+
+	if len(s.windows) == 0 {
+		return nil, fmt.Errorf("schedule \"%s\" contains no windows", text)
+	}
+
+	return s, nil
+}
+
+// parseWeekdays parses a list of weekdays and weekday ranges like "mon-fri,sun".
+func parseWeekdays(text string) ([]time.Weekday, error) {
+	var days []time.Weekday
+
+	for _, part := range strings.Split(strings.ToLower(text), ",") {
+		from, to, isRange := strings.Cut(part, "-")
+
+		first, ok := weekdays[from]
+		if !ok {
+			return nil, fmt.Errorf("invalid weekday \"%s\"", from)
+		}
+
+		last := first
+
+		if isRange {
+			last, ok = weekdays[to]
+			if !ok {
+				return nil, fmt.Errorf("invalid weekday \"%s\"", to)
+			}
+		}
+
+		for day := first; ; day = (day + 1) % 7 {
+			days = append(days, day)
+
+			if day == last {
+				break
+			}
+		}
+	}
+
+	return days, nil
+}
+
+// parseTimeWindow parses a window like "22:00-06:00".
+//
+// @return start and end in minutes since midnight.
+func parseTimeWindow(text string) (int, int, error) {
+	from, to, ok := strings.Cut(text, "-")
+	if !ok {
+		return 0, 0, fmt.Errorf("invalid time window \"%s\", expected \"HH:MM-HH:MM\"", text)
+	}
+
+	start, err := parseTimeOfDay(from)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	end, err := parseTimeOfDay(to)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	if start == 24*60 || start == end {
+		return 0, 0, fmt.Errorf("invalid time window \"%s\"", text)
+	}
+
+	return start, end, nil
+}
+
+// parseTimeOfDay parses "HH:MM" between "00:00" and "24:00".
+//
+// @return minutes since midnight.
+func parseTimeOfDay(text string) (int, error) {
+	h, m, ok := strings.Cut(text, ":")
+
+	hours, err1 := strconv.Atoi(h)
+	minutes, err2 := strconv.Atoi(m)
+
+	if !ok || err1 != nil || err2 != nil || hours < 0 || minutes < 0 || minutes > 59 ||
+		hours > 24 || (hours == 24 && minutes != 0) {
+
+		return 0, fmt.Errorf("invalid time of day \"%s\"", text)
+	}
+
+	return hours*60 + minutes, nil
+}
+
+// contains checks, if the given time lies within one of the windows.
+func (s *schedule) contains(t time.Time) bool {
+	t = t.In(s.location)
+	minute := t.Hour()*60 + t.Minute()
+
+	for _, window := range s.windows {
+		if window.weekday == t.Weekday() && minute >= window.start && minute < window.end {
+			return true
+		}
+	}
+
+	return false
+}
+
+// InSchedule - Checks, if the current time lies within the `Schedule`.
+//
+// @return true, if no schedule is set, or if the schedule is invalid.
+func (sp *SnowflakeProxy) InSchedule() bool {
+	if sp.Schedule == "" {
+		return true
+	}
+
+	s, err := parseSchedule(sp.Schedule, sp.ScheduleTimeZone)
+	if err != nil {
+		return true
+	}
+
+	return s.contains(time.Now())
+}
+
+// validateSchedule checks, if `Schedule` and `ScheduleTimeZone` are valid.
+func (sp *SnowflakeProxy) validateSchedule() error {
+	if sp.Schedule == "" {
+		return nil
+	}
+
+	_, err := parseSchedule(sp.Schedule, sp.ScheduleTimeZone)
+
+	return err
+}
+
+// startSchedule starts pausing and resuming polling according to the schedule.
+func (sp *SnowflakeProxy) startSchedule() {
+	if sp.Schedule == "" {
+		return
+	}
+
+	s, err := parseSchedule(sp.Schedule, sp.ScheduleTimeZone)
+	if err != nil {
+		// Already validated in SnowflakeProxy.Start.
+		return
+	}
+
+	sp.mutex.Lock()
+	sp.scheduleShutdown = make(chan struct{})
+	sp.scheduleWindowEnded = time.Time{}
+	shutdown := sp.scheduleShutdown
+	sp.mutex.Unlock()
+
+	// No clients, yet.
+	sp.applySchedule(s, time.Now(), 0)
+
+	go func() {
+		ticker := time.NewTicker(scheduleCheckInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-shutdown:
+				return
+
+			case <-ticker.C:
+				sp.applySchedule(s, time.Now(), sp.ActiveSessions())
+			}
+		}
+	}()
+}
+
+// stopSchedule stops applying the schedule.
+func (sp *SnowflakeProxy) stopSchedule() {
+	sp.mutex.Lock()
+
+	if sp.scheduleShutdown != nil {
+		close(sp.scheduleShutdown)
+		sp.scheduleShutdown = nil
+	}
+
+	sp.scheduleWindowEnded = time.Time{}
+
+	sp.mutex.Unlock()
+
+	sp.setPollingPaused(pauseReasonSchedule, false)
+}
+
+// applySchedule resumes polling at the beginning of a window. At the end of a window, it pauses polling, as soon as
+// no client is served anymore or `ScheduleGracePeriodMinutes` expired.
+func (sp *SnowflakeProxy) applySchedule(s *schedule, now time.Time, activeSessions int) {
+	inside := s.contains(now)
+
+	sp.mutex.Lock()
+
+	paused := sp.pauseReasons[pauseReasonSchedule]
+
+	if inside {
+		sp.scheduleWindowEnded = time.Time{}
+		sp.mutex.Unlock()
+
+		if paused {
+			ptlog.Noticef("Snowflake proxy schedule window began, resuming")
+			sp.setPollingPaused(pauseReasonSchedule, false)
+		}
+
+		return
+	}
+
+	if paused {
+		sp.mutex.Unlock()
+		return
+	}
+
+	if sp.scheduleWindowEnded.IsZero() {
+		sp.scheduleWindowEnded = now
+	}
+
+	graceExpired := sp.ScheduleGracePeriodMinutes > 0 &&
+		now.Sub(sp.scheduleWindowEnded) >= time.Duration(sp.ScheduleGracePeriodMinutes)*time.Minute
+
+	sp.mutex.Unlock()
+
+	switch {
+	case activeSessions == 0:
+		ptlog.Noticef("Snowflake proxy schedule window ended, pausing")
+
+	case graceExpired:
+		ptlog.Noticef("Snowflake proxy schedule grace period expired, pausing and disconnecting clients")
+
+	default:
+		return
+	}
+
+	sp.setPollingPaused(pauseReasonSchedule, true)
+}
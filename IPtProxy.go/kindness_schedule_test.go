@@ -0,0 +1,169 @@
+package IPtProxy
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseSchedule(t *testing.T) {
+	tests := []struct {
+		schedule string
+		timeZone string
+		windows  int
+		wantErr  bool
+	}{
+		{"mon 08:00-12:00", "", 1, false},
+		{"mon-fri 08:00-12:00", "", 5, false},
+		{"mon,wed 08:00-12:00,14:00-18:00", "", 4, false},
+		{"mon-fri 22:00-06:00; sat,sun 00:00-24:00", "", 12, false},
+		{"fri-mon 22:00-06:00", "", 8, false},
+		{"sun 23:00-01:00", "Europe/Berlin", 2, false},
+		{"MON 08:00-12:00", "", 1, false},
+		{" ; mon 08:00-12:00 ; ", "", 1, false},
+		{"", "", 0, true},
+		{"mon", "", 0, true},
+		{"mon 08:00-12:00 extra", "", 0, true},
+		{"monday 08:00-12:00", "", 0, true},
+		{"mon-xyz 08:00-12:00", "", 0, true},
+		{"mon 08:00", "", 0, true},
+		{"mon 08:00-08:00", "", 0, true},
+		{"mon 24:00-08:00", "", 0, true},
+		{"mon 08:00-24:01", "", 0, true},
+		{"mon 08:60-12:00", "", 0, true},
+		{"mon 8-12", "", 0, true},
+		{"mon 08:00-12:00", "Mars/Olympus_Mons", 0, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.schedule, func(t *testing.T) {
+			s, err := parseSchedule(tt.schedule, tt.timeZone)
+
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v, want error: %v", err, tt.wantErr)
+			}
+
+			if err == nil && len(s.windows) != tt.windows {
+				t.Errorf("got %d windows, want %d", len(s.windows), tt.windows)
+			}
+		})
+	}
+}
+
+func TestScheduleContains(t *testing.T) {
+	berlin, err := time.LoadLocation("Europe/Berlin")
+	if err != nil {
+		t.Skip("no time zone database")
+	}
+
+	// 2024-01-01 was a Monday.
+	day := func(day, hour, minute int) time.Time {
+		return time.Date(2024, 1, day, hour, minute, 0, 0, time.UTC)
+	}
+
+	tests := []struct {
+		name     string
+		schedule string
+		timeZone string
+		time     time.Time
+		want     bool
+	}{
+		{"inside", "mon 08:00-12:00", "UTC", day(1, 10, 0), true},
+		{"start inclusive", "mon 08:00-12:00", "UTC", day(1, 8, 0), true},
+		{"end exclusive", "mon 08:00-12:00", "UTC", day(1, 12, 0), false},
+		{"other day", "mon 08:00-12:00", "UTC", day(2, 10, 0), false},
+		{"overnight evening", "mon-fri 22:00-06:00", "UTC", day(5, 23, 0), true},
+		{"overnight into saturday", "mon-fri 22:00-06:00", "UTC", day(6, 5, 59), true},
+		{"overnight ended saturday", "mon-fri 22:00-06:00", "UTC", day(6, 6, 0), false},
+		{"overnight not into monday", "mon-fri 22:00-06:00", "UTC", day(1, 5, 0), false},
+		{"overnight into tuesday", "mon-fri 22:00-06:00", "UTC", day(2, 5, 0), true},
+		{"overnight from sunday into monday", "sun 23:00-01:00", "UTC", day(8, 0, 30), true},
+		{"wrapping weekdays", "fri-mon 10:00-11:00", "UTC", day(7, 10, 30), true},
+		{"wrapping weekdays excluded", "fri-mon 10:00-11:00", "UTC", day(3, 10, 30), false},
+		{"whole day", "sat,sun 00:00-24:00", "UTC", day(7, 23, 59), true},
+		{"time zone", "mon 08:00-12:00", "Europe/Berlin", day(1, 7, 30), true},
+		{"time zone outside", "mon 08:00-12:00", "Europe/Berlin", day(1, 11, 30), false},
+		{"time zone overnight", "sun 23:00-01:00", "Europe/Berlin", day(7, 22, 30), true},
+		{"time given in other zone", "mon 08:00-12:00", "UTC", time.Date(2024, 1, 1, 10, 0, 0, 0, berlin), true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := parseSchedule(tt.schedule, tt.timeZone)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got := s.contains(tt.time); got != tt.want {
+				t.Errorf("contains %s: %v, want %v", tt.time, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestApplySchedule(t *testing.T) {
+	s, err := parseSchedule("mon 22:00-06:00", "UTC")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	at := func(day, hour, minute int) time.Time {
+		return time.Date(2024, 1, day, hour, minute, 0, 0, time.UTC)
+	}
+
+	type step struct {
+		time     time.Time
+		sessions int
+		paused   bool
+	}
+
+	tests := []struct {
+		name  string
+		grace int
+		steps []step
+	}{
+		{"outside without clients", 0, []step{
+			{at(1, 21, 0), 0, true},
+			{at(1, 22, 0), 0, false},
+		}},
+		{"keep clients without grace period", 0, []step{
+			{at(1, 23, 0), 0, false},
+			{at(2, 6, 0), 2, false},
+			{at(2, 9, 0), 1, false},
+			{at(2, 9, 30), 0, true},
+		}},
+		{"grace period expires", 30, []step{
+			{at(1, 23, 0), 0, false},
+			{at(2, 6, 0), 2, false},
+			{at(2, 6, 29), 2, false},
+			{at(2, 6, 30), 2, true},
+			{at(2, 7, 0), 0, true},
+		}},
+		{"clients leave within grace period", 30, []step{
+			{at(1, 23, 0), 0, false},
+			{at(2, 6, 0), 2, false},
+			{at(2, 6, 10), 0, true},
+		}},
+		{"next window resets grace period", 30, []step{
+			{at(1, 23, 0), 0, false},
+			{at(2, 6, 0), 2, false},
+			{at(2, 6, 30), 2, true},
+			{at(8, 22, 0), 0, false},
+			{at(9, 6, 0), 1, false},
+			{at(9, 6, 29), 1, false},
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sp := &SnowflakeProxy{ScheduleGracePeriodMinutes: tt.grace}
+
+			for i, step := range tt.steps {
+				sp.applySchedule(s, step.time, step.sessions)
+
+				if paused := !sp.pollingAllowed(); paused != step.paused {
+					t.Errorf("step %d: paused: %v, want %v", i, paused, step.paused)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,68 @@
+package IPtProxy
+
+// SnowflakeSessionEvents - Interface to follow the client sessions of the Snowflake proxy. A session begins, when
+// the data channel to a client opens, and ends, when it closes.
+//
+// The proxy library doesn't identify sessions in its events and doesn't report the client's NAT type, the relay
+// used or the bytes transferred per client. When several clients are served at once, the end of a session can't
+// even be matched to its start. Therefore, only what the library reports is passed on.
+type SnowflakeSessionEvents interface {
+
+	// SessionStarted - The data channel to a new client opened.
+	//
+	// @param activeSessions The number of clients served right now, including the new one.
+	SessionStarted(activeSessions int)
+
+	// SessionEnded - The data channel to a client closed.
+	//
+	// @param country The client's country code as reported by the proxy library. Empty, if unknown.
+	//
+	// @param activeSessions The number of clients served right now, without the one which left.
+	SessionEnded(country string, activeSessions int)
+}
+
+// ActiveSessions - The number of clients the Snowflake proxy serves right now.
+func (sp *SnowflakeProxy) ActiveSessions() int {
+	sp.stateMutex.Lock()
+	run := sp.run
+	sp.stateMutex.Unlock()
+
+	if run == nil {
+		return 0
+	}
+
+	sp.mutex.Lock()
+	defer sp.mutex.Unlock()
+
+	return run.activeSessions
+}
+
+// startSession counts and reports a new client session of the given run.
+func (sp *SnowflakeProxy) startSession(run *snowflakeRun) {
+	sp.mutex.Lock()
+	run.activeSessions++
+	sp.mutex.Unlock()
+
+	if sp.SessionEvents != nil {
+		go sp.SessionEvents.SessionStarted(sp.ActiveSessions())
+	}
+}
+
+// endSession counts and reports the end of a client session of the given run.
+func (sp *SnowflakeProxy) endSession(run *snowflakeRun, country string) {
+	sp.mutex.Lock()
+	// Never count below zero, in case the library reports a data channel closing, which never opened.
+	if run.activeSessions > 0 {
+		run.activeSessions--
+	}
+	restart := sp.restartPending && run.activeSessions == 0
+	sp.mutex.Unlock()
+
+	if restart {
+		go sp.restartRunWhenIdle()
+	}
+
+	if sp.SessionEvents != nil {
+		go sp.SessionEvents.SessionEnded(country, sp.ActiveSessions())
+	}
+}
@@ -0,0 +1,428 @@
+package IPtProxy
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	ptlog "gitlab.torproject.org/tpo/anti-censorship/pluggable-transports/lyrebird/common/log"
+	"gitlab.torproject.org/tpo/anti-censorship/pluggable-transports/snowflake/v2/common/event"
+	sfp "gitlab.torproject.org/tpo/anti-censorship/pluggable-transports/snowflake/v2/proxy/lib"
+)
+
+//goland:noinspection GoUnusedConst
+const (
+	// SnowflakeStateStarting - The proxy checks its configuration and probes its NAT type.
+	SnowflakeStateStarting = "starting"
+
+	// SnowflakeStateRunning - The proxy polls the broker for clients, unless it's paused.
+	SnowflakeStateRunning = "running"
+
+	// SnowflakeStateStopping - The proxy is shutting down.
+	SnowflakeStateStopping = "stopping"
+
+	// SnowflakeStateStopped - The proxy is not running.
+	SnowflakeStateStopped = "stopped"
+)
+
+// defaultStartTimeout - Used by SnowflakeProxy.StartAndWait, if no timeout is given.
+const defaultStartTimeout = 60 * time.Second
+
+// errStoppedDuringStartup - Returned to waiters, when the proxy was stopped before it finished starting.
+var errStoppedDuringStartup = errors.New("snowflake proxy was stopped during startup")
+
+// errStillStopping - Returned, when the proxy is started, while it's still stopping.
+var errStillStopping = errors.New("snowflake proxy is still stopping")
+
+// errAnotherProxyRunning - Returned, when a SnowflakeProxy is started, while another one is running.
+var errAnotherProxyRunning = errors.New("another SnowflakeProxy is already running in this process")
+
+var (
+	// libraryMutex - Guards `libraryOwner` and `libraryRunDone`.
+	libraryMutex sync.Mutex
+
+	// libraryOwner - The SnowflakeProxy currently using the proxy library, if any.
+	libraryOwner *SnowflakeProxy
+
+	// libraryRunDone - Closed, when the latest run of the proxy library returned.
+	libraryRunDone chan struct{}
+)
+
+// snowflakeRun - One run of the proxy library, from its start until it's stopped.
+type snowflakeRun struct {
+	sp    *SnowflakeProxy
+	proxy *sfp.SnowflakeProxy
+
+	// started - Closed, when the library finished its startup or returned.
+	started     chan struct{}
+	startedOnce sync.Once
+
+	// done - Closed, when the library returned.
+	done chan struct{}
+
+	// stopped and activeSessions are guarded by `SnowflakeProxy.mutex`.
+	stopped        bool
+	activeSessions int
+}
+
+func (r *snowflakeRun) OnNewSnowflakeEvent(e event.SnowflakeEvent) {
+	r.sp.onRunEvent(r, e)
+}
+
+func (r *snowflakeRun) markStarted() {
+	r.startedOnce.Do(func() {
+		close(r.started)
+	})
+}
+
+func (r *snowflakeRun) isStopped() bool {
+	r.sp.mutex.Lock()
+	defer r.sp.mutex.Unlock()
+
+	return r.stopped
+}
+
+// stop stops the library as soon as its startup finished. It cannot be stopped before. This disconnects all
+// clients.
+func (r *snowflakeRun) stop() {
+	r.sp.mutex.Lock()
+	r.stopped = true
+	r.sp.mutex.Unlock()
+
+	go func() {
+		<-r.started
+
+		r.proxy.Stop()
+	}()
+}
+
+// SnowflakeStateEvents - Interface to get notified about state changes of the Snowflake proxy.
+type SnowflakeStateEvents interface {
+
+	// StateChanged - Called on every state change.
+	//
+	// @param state One of `SnowflakeStateStarting`, `SnowflakeStateRunning`, `SnowflakeStateStopping` or
+	// `SnowflakeStateStopped`.
+	//
+	// @param error The error which caused the proxy to stop, if any.
+	StateChanged(state string, error error)
+}
+
+// State - The current state of the proxy.
+//
+// @return one of `SnowflakeStateStarting`, `SnowflakeStateRunning`, `SnowflakeStateStopping` or
+// `SnowflakeStateStopped`.
+func (sp *SnowflakeProxy) State() string {
+	sp.stateMutex.Lock()
+	defer sp.stateMutex.Unlock()
+
+	if sp.state == "" {
+		return SnowflakeStateStopped
+	}
+
+	return sp.state
+}
+
+// StartAndWait - Start the Snowflake proxy and block until the proxy library finished its startup (configuration
+// checks, broker setup and NAT probe). If polling is paused right away, it returns without waiting.
+// The library doesn't report the outcome of its broker polls, so this can't wait for the first one. Follow
+// `ClientEvents` to see clients arrive.
+//
+// @param timeoutSeconds Maximum time to wait. Defaults to 60 seconds, if <= 0. The proxy is stopped, when it expires.
+//
+// @throws if the configuration is invalid, if the proxy is still stopping, if the proxy library failed to start, or
+// if the timeout expired.
+func (sp *SnowflakeProxy) StartAndWait(timeoutSeconds int) error {
+	if err := sp.Start(); err != nil {
+		return err
+	}
+
+	timeout := defaultStartTimeout
+	if timeoutSeconds > 0 {
+		timeout = time.Duration(timeoutSeconds) * time.Second
+	}
+
+	sp.stateMutex.Lock()
+	startup := sp.startup
+	sp.stateMutex.Unlock()
+
+	if startup == nil {
+		return errStoppedDuringStartup
+	}
+
+	select {
+	case <-startup:
+	case <-time.After(timeout):
+		sp.Stop()
+		return fmt.Errorf("snowflake proxy did not start within %s", timeout)
+	}
+
+	sp.stateMutex.Lock()
+	defer sp.stateMutex.Unlock()
+
+	return sp.startupErr
+}
+
+// setState changes the state and notifies the delegate. Needs `stateMutex` to be held.
+func (sp *SnowflakeProxy) setState(state string, err error) {
+	sp.state = state
+
+	ptlog.Noticef("Snowflake proxy %s", state)
+
+	if sp.StateEvents != nil {
+		go sp.StateEvents.StateChanged(state, err)
+	}
+}
+
+// finishStartup releases everybody waiting for the startup to finish. Needs `stateMutex` to be held.
+func (sp *SnowflakeProxy) finishStartup(err error) {
+	if sp.startup == nil {
+		return
+	}
+
+	select {
+	case <-sp.startup:
+		// Already finished.
+
+	default:
+		sp.startupErr = err
+		close(sp.startup)
+	}
+}
+
+// claimProxyLibrary makes the given proxy the only one using the proxy library.
+//
+// @throws errAnotherProxyRunning, if another proxy uses it.
+func claimProxyLibrary(sp *SnowflakeProxy) error {
+	libraryMutex.Lock()
+	defer libraryMutex.Unlock()
+
+	if libraryOwner != nil && libraryOwner != sp {
+		return errAnotherProxyRunning
+	}
+
+	libraryOwner = sp
+
+	return nil
+}
+
+// releaseProxyLibrary allows other proxies to use the proxy library again.
+func releaseProxyLibrary(sp *SnowflakeProxy) {
+	libraryMutex.Lock()
+	defer libraryMutex.Unlock()
+
+	if libraryOwner == sp {
+		libraryOwner = nil
+	}
+}
+
+// updateRun starts the proxy library, if polling is allowed, and stops it, if not.
+func (sp *SnowflakeProxy) updateRun() {
+	sp.stateMutex.Lock()
+	defer sp.stateMutex.Unlock()
+
+	sp.updateRunLocked()
+}
+
+// updateRunLocked needs `stateMutex` to be held.
+func (sp *SnowflakeProxy) updateRunLocked() {
+	if sp.state != SnowflakeStateStarting && sp.state != SnowflakeStateRunning {
+		return
+	}
+
+	allowed := sp.pollingAllowed()
+
+	if allowed && sp.run == nil {
+		if sp.state == SnowflakeStateRunning {
+			ptlog.Noticef("Snowflake proxy resumes polling")
+		}
+
+		sp.startRun()
+	} else if !allowed && sp.run != nil {
+		ptlog.Noticef("Snowflake proxy pauses polling and disconnects all clients")
+
+		sp.stopRun()
+	}
+
+	if sp.state == SnowflakeStateStarting && sp.run == nil {
+		// Paused right from the start, there's no library startup to wait for.
+		sp.setState(SnowflakeStateRunning, nil)
+		sp.finishStartup(nil)
+	}
+}
+
+// startRun starts a new run of the proxy library. Needs `stateMutex` to be held.
+func (sp *SnowflakeProxy) startRun() {
+	run := &snowflakeRun{
+		sp:      sp,
+		started: make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+
+	eventDispatcher := event.NewSnowflakeEventDispatcher()
+	eventDispatcher.AddSnowflakeEventListener(run)
+
+	// The traffic is only reported with the periodic statistics, which are needed for the data caps.
+	summaryInterval := libraryStatsInterval
+	if sp.SummaryInterval > 0 {
+		summaryInterval = min(summaryInterval, time.Duration(sp.SummaryInterval)*time.Second)
+	}
+
+	run.proxy = &sfp.SnowflakeProxy{
+		PollInterval:                    time.Duration(sp.PollInterval) * time.Second,
+		Capacity:                        uint(sp.Capacity),
+		BrokerURL:                       sp.BrokerUrl,
+		KeepLocalAddresses:              sp.KeepLocalAddresses,
+		RelayURL:                        sp.RelayUrl,
+		EphemeralMinPort:                uint16(sp.EphemeralMinPort),
+		EphemeralMaxPort:                uint16(sp.EphemeralMaxPort),
+		RelayDomainNamePattern:          sp.RelayDomainNamePattern,
+		AllowProxyingToPrivateAddresses: sp.AllowProxyingToPrivateAddresses,
+		AllowNonTLSRelay:                sp.AllowNonTLSRelay,
+		NATProbeURL:                     sp.NatProbeUrl,
+		NATTypeMeasurementInterval:      time.Duration(sp.NATTypeMeasurementInterval),
+		ProxyType:                       sp.ProxyTypeIdentifier,
+		EventDispatcher:                 eventDispatcher,
+		SummaryInterval:                 summaryInterval,
+		CovertDTLSConfig:                sp.covertDtlsConf,
+	}
+
+	sp.run = run
+
+	sp.mutex.Lock()
+	sp.restartPending = false
+	sp.mutex.Unlock()
+
+	// The library keeps its broker and client slots in package-level variables, so a run may only start, after the
+	// previous one returned.
+	libraryMutex.Lock()
+	previous := libraryRunDone
+	libraryRunDone = run.done
+	libraryMutex.Unlock()
+
+	go func() {
+		if previous != nil {
+			<-previous
+		}
+
+		if run.isStopped() {
+			close(run.done)
+			run.markStarted()
+
+			return
+		}
+
+		servers := sp.selectStunServers()
+
+		// The library is not running, yet, so it's safe to change its configuration here.
+		run.proxy.STUNURL = strings.Join(servers, ",")
+
+		err := run.proxy.Start()
+
+		close(run.done)
+
+		sp.onRunEnded(run, err)
+	}()
+}
+
+// restartRunWhenIdle starts the proxy library again, so it measures the NAT type again. As this disconnects all
+// clients, it's postponed until the last one of the current run disconnected.
+func (sp *SnowflakeProxy) restartRunWhenIdle() {
+	sp.stateMutex.Lock()
+	defer sp.stateMutex.Unlock()
+
+	// While paused, the next run measures the NAT type anyway.
+	if sp.state != SnowflakeStateRunning || sp.run == nil {
+		return
+	}
+
+	sp.mutex.Lock()
+	idle := sp.run.activeSessions == 0
+	sp.restartPending = !idle
+	sp.mutex.Unlock()
+
+	if !idle {
+		ptlog.Noticef("Snowflake proxy will restart, when no client is served anymore")
+		return
+	}
+
+	ptlog.Noticef("Snowflake proxy restarts")
+
+	sp.stopRun()
+	sp.startRun()
+}
+
+// stopRun stops the current run of the proxy library, which disconnects all clients. Needs `stateMutex` to be held.
+func (sp *SnowflakeProxy) stopRun() {
+	sp.run.stop()
+	sp.run = nil
+}
+
+// isCurrentRun checks, if the given run is the current one.
+func (sp *SnowflakeProxy) isCurrentRun(run *snowflakeRun) bool {
+	sp.stateMutex.Lock()
+	defer sp.stateMutex.Unlock()
+
+	return sp.run == run
+}
+
+// onRunStarted is called, when the proxy library finished its startup.
+func (sp *SnowflakeProxy) onRunStarted(run *snowflakeRun) {
+	sp.stateMutex.Lock()
+	defer sp.stateMutex.Unlock()
+
+	if sp.run == run && sp.state == SnowflakeStateStarting {
+		sp.setState(SnowflakeStateRunning, nil)
+		sp.finishStartup(nil)
+	}
+}
+
+// onRunEnded is called, when the proxy library returned. Without an error, it was stopped. With an error, it failed
+// to start, and the whole proxy is stopped.
+func (sp *SnowflakeProxy) onRunEnded(run *snowflakeRun, err error) {
+	run.markStarted()
+
+	if err == nil {
+		return
+	}
+
+	ptlog.Errorf("Snowflake proxy failed: %s", err.Error())
+
+	sp.stateMutex.Lock()
+
+	if sp.run != run {
+		sp.stateMutex.Unlock()
+		return
+	}
+
+	sp.run = nil
+	sp.setState(SnowflakeStateStopping, nil)
+
+	sp.stateMutex.Unlock()
+
+	sp.finishStop(err)
+}
+
+// finishStop cleans up and transitions to `SnowflakeStateStopped`. The proxy library needs to be stopped already.
+func (sp *SnowflakeProxy) finishStop(err error) {
+	sp.stopPolicy()
+	sp.stopSchedule()
+	sp.stopStunChecks()
+	sp.stopUsageTracking()
+	sp.stopStats()
+
+	sp.stateMutex.Lock()
+	defer sp.stateMutex.Unlock()
+
+	if err != nil {
+		sp.finishStartup(err)
+	} else {
+		sp.finishStartup(errStoppedDuringStartup)
+	}
+
+	releaseProxyLibrary(sp)
+
+	sp.setState(SnowflakeStateStopped, err)
+}
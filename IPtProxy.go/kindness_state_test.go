@@ -0,0 +1,58 @@
+package IPtProxy
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+type testStateEvents struct {
+	states chan string
+}
+
+func (e *testStateEvents) StateChanged(state string, _ error) {
+	e.states <- state
+}
+
+func TestStartAndWaitReportsFailure(t *testing.T) {
+	events := &testStateEvents{states: make(chan string, 10)}
+
+	sp := &SnowflakeProxy{
+		BrokerUrl:   "://invalid",
+		StunServers: "stun:127.0.0.1:3478",
+		StateEvents: events,
+	}
+
+	err := sp.StartAndWait(30)
+	if err == nil || !strings.Contains(err.Error(), "broker") {
+		t.Fatalf("started with %v, want broker error", err)
+	}
+
+	if sp.State() != SnowflakeStateStopped {
+		t.Errorf("state %s, want %s", sp.State(), SnowflakeStateStopped)
+	}
+
+	// Runs the library again, after the failed run returned.
+	if err = sp.StartAndWait(30); err == nil {
+		t.Error("restarted without error")
+	}
+
+	// Starting, stopping and stopped, twice. They're reported on their own goroutines, so in any order.
+	counts := map[string]int{}
+
+	for range 6 {
+		select {
+		case state := <-events.states:
+			counts[state]++
+
+		case <-time.After(5 * time.Second):
+			t.Fatalf("got states %v, want starting, stopping and stopped twice", counts)
+		}
+	}
+
+	for _, state := range []string{SnowflakeStateStarting, SnowflakeStateStopping, SnowflakeStateStopped} {
+		if counts[state] != 2 {
+			t.Errorf("got states %v, want starting, stopping and stopped twice", counts)
+		}
+	}
+}
@@ -0,0 +1,197 @@
+package IPtProxy
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path"
+	"time"
+
+	ptlog "gitlab.torproject.org/tpo/anti-censorship/pluggable-transports/lyrebird/common/log"
+)
+
+// SnowflakeStatsFileName - the filename of the persisted lifetime statistics residing in `SnowflakeProxy.StateDir`.
+const SnowflakeStatsFileName = "snowflake-stats.json"
+
+// maxNatTypeHistory - Only that many NAT type changes are kept.
+const maxNatTypeHistory = 100
+
+// natTypeChange - A NAT type determined at a certain time.
+type natTypeChange struct {
+	Time    time.Time `json:"time"`
+	NatType string    `json:"natType"`
+}
+
+// snowflakeLifetimeStats - Cumulative statistics of the proxy, as persisted to `SnowflakeStatsFileName`.
+type snowflakeLifetimeStats struct {
+	FirstStarted      time.Time        `json:"firstStarted"`
+	ClientsServed     int64            `json:"clientsServed"`
+	FailedConnections int64            `json:"failedConnections"`
+	TotalBytes        int64            `json:"totalBytes"`
+	UptimeSeconds     int64            `json:"uptimeSeconds"`
+	Countries         map[string]int64 `json:"countries"`
+	NatTypeHistory    []natTypeChange  `json:"natTypeHistory"`
+}
+
+// LifetimeStats - Cumulative statistics of the proxy across all restarts.
+// Only persisted across app restarts, if `StateDir` is set.
+//
+// @return a JSON object with the fields `firstStarted` (RFC 3339 timestamp), `clientsServed`, `failedConnections`,
+// `totalBytes` (in both directions), `uptimeSeconds`, `countries` (an object mapping country codes to the number of
+// clients served from there) and `natTypeHistory` (an array of objects with `time` and `natType`).
+func (sp *SnowflakeProxy) LifetimeStats() string {
+	sp.mutex.Lock()
+	loaded := sp.statsLoaded
+	sp.mutex.Unlock()
+
+	if !loaded {
+		sp.loadStats()
+	}
+
+	sp.mutex.Lock()
+
+	stats := sp.stats
+	stats.UptimeSeconds += sp.currentUptime()
+
+	data, err := json.Marshal(stats)
+
+	sp.mutex.Unlock()
+
+	if err != nil {
+		ptlog.Warnf("Failed to encode Snowflake proxy stats: %s", err.Error())
+		return "{}"
+	}
+
+	return string(data)
+}
+
+// currentUptime returns the seconds since the uptime was last accounted. Needs `mutex` to be held.
+func (sp *SnowflakeProxy) currentUptime() int64 {
+	if sp.uptimeSince.IsZero() {
+		return 0
+	}
+
+	return int64(time.Since(sp.uptimeSince).Seconds())
+}
+
+// loadStats reads the persisted lifetime statistics from `StateDir`, if any.
+func (sp *SnowflakeProxy) loadStats() {
+	stats := snowflakeLifetimeStats{}
+
+	if sp.StateDir != "" {
+		data, err := os.ReadFile(path.Join(sp.StateDir, SnowflakeStatsFileName))
+		if err == nil {
+			err = json.Unmarshal(data, &stats)
+		}
+
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			ptlog.Warnf("Failed to read Snowflake proxy stats: %s", err.Error())
+		}
+	}
+
+	if stats.Countries == nil {
+		stats.Countries = make(map[string]int64)
+	}
+
+	sp.mutex.Lock()
+	sp.stats = stats
+	sp.statsLoaded = true
+	sp.mutex.Unlock()
+}
+
+// saveStats persists the lifetime statistics to `StateDir`, if set.
+func (sp *SnowflakeProxy) saveStats() {
+	sp.mutex.Lock()
+
+	// Account uptime until now.
+	sp.stats.UptimeSeconds += sp.currentUptime()
+	if !sp.uptimeSince.IsZero() {
+		sp.uptimeSince = time.Now()
+	}
+
+	if sp.StateDir == "" {
+		sp.mutex.Unlock()
+		return
+	}
+
+	data, err := json.Marshal(sp.stats)
+
+	sp.mutex.Unlock()
+
+	if err != nil {
+		ptlog.Warnf("Failed to encode Snowflake proxy stats: %s", err.Error())
+		return
+	}
+
+	if err = writeFileAtomically(path.Join(sp.StateDir, SnowflakeStatsFileName), data); err != nil {
+		ptlog.Warnf("Failed to write Snowflake proxy stats: %s", err.Error())
+	}
+}
+
+// startStats loads the persisted statistics, if not done already, and starts counting uptime.
+func (sp *SnowflakeProxy) startStats() {
+	sp.mutex.Lock()
+	loaded := sp.statsLoaded
+	sp.mutex.Unlock()
+
+	if !loaded {
+		sp.loadStats()
+	}
+
+	sp.mutex.Lock()
+	if sp.stats.FirstStarted.IsZero() {
+		sp.stats.FirstStarted = time.Now().UTC()
+	}
+	sp.uptimeSince = time.Now()
+	sp.mutex.Unlock()
+}
+
+// stopStats stops counting uptime and persists the statistics.
+func (sp *SnowflakeProxy) stopStats() {
+	sp.saveStats()
+
+	sp.mutex.Lock()
+	sp.uptimeSince = time.Time{}
+	sp.mutex.Unlock()
+}
+
+func (sp *SnowflakeProxy) recordClientServed(country string) {
+	if country == "" {
+		country = "??"
+	}
+
+	sp.mutex.Lock()
+	sp.stats.ClientsServed++
+	sp.stats.Countries[country]++
+	sp.mutex.Unlock()
+}
+
+func (sp *SnowflakeProxy) recordConnectionFailed() {
+	sp.mutex.Lock()
+	sp.stats.FailedConnections++
+	sp.mutex.Unlock()
+}
+
+// recordBytes needs `mutex` to be held.
+func (sp *SnowflakeProxy) recordBytes(n int64) {
+	sp.stats.TotalBytes += n
+}
+
+func (sp *SnowflakeProxy) recordNatType(natType string) {
+	sp.mutex.Lock()
+	defer sp.mutex.Unlock()
+
+	sp.natType = natType
+
+	history := sp.stats.NatTypeHistory
+	if len(history) > 0 && history[len(history)-1].NatType == natType {
+		return
+	}
+
+	history = append(history, natTypeChange{Time: time.Now().UTC(), NatType: natType})
+	if len(history) > maxNatTypeHistory {
+		history = history[len(history)-maxNatTypeHistory:]
+	}
+
+	sp.stats.NatTypeHistory = history
+}
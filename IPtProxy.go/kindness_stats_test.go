@@ -0,0 +1,159 @@
+package IPtProxy
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestLifetimeStats(t *testing.T) {
+	tests := []struct {
+		name      string
+		countries []string
+		failed    int
+		bytes     []int64
+		natTypes  []string
+		want      snowflakeLifetimeStats
+	}{
+		{
+			name: "nothing",
+			want: snowflakeLifetimeStats{Countries: map[string]int64{}},
+		},
+		{
+			name:      "clients",
+			countries: []string{"de", "", "de", "ir"},
+			failed:    2,
+			want: snowflakeLifetimeStats{
+				ClientsServed:     4,
+				FailedConnections: 2,
+				Countries:         map[string]int64{"de": 2, "??": 1, "ir": 1},
+			},
+		},
+		{
+			name:  "bytes",
+			bytes: []int64{1000, 2500},
+			want:  snowflakeLifetimeStats{TotalBytes: 3500, Countries: map[string]int64{}},
+		},
+		{
+			name:     "nat type changes only",
+			natTypes: []string{NATUnknown, NATUnknown, NATRestricted, NATRestricted, NATUnrestricted},
+			want: snowflakeLifetimeStats{
+				Countries: map[string]int64{},
+				NatTypeHistory: []natTypeChange{
+					{NatType: NATUnknown}, {NatType: NATRestricted}, {NatType: NATUnrestricted},
+				},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+
+			sp := &SnowflakeProxy{StateDir: dir}
+			sp.startStats()
+
+			for _, country := range tt.countries {
+				sp.recordClientServed(country)
+			}
+
+			for range tt.failed {
+				sp.recordConnectionFailed()
+			}
+
+			for _, n := range tt.bytes {
+				sp.addUsage(n)
+			}
+
+			for _, natType := range tt.natTypes {
+				sp.recordNatType(natType)
+			}
+
+			sp.stopStats()
+
+			// A new object only knows the persisted statistics.
+			var got snowflakeLifetimeStats
+			if err := json.Unmarshal([]byte((&SnowflakeProxy{StateDir: dir}).LifetimeStats()), &got); err != nil {
+				t.Fatal(err)
+			}
+
+			if got.FirstStarted.IsZero() {
+				t.Error("first start not recorded")
+			}
+
+			if got.ClientsServed != tt.want.ClientsServed || got.FailedConnections != tt.want.FailedConnections ||
+				got.TotalBytes != tt.want.TotalBytes {
+
+				t.Errorf("got %d clients, %d failed, %d bytes, want %d, %d, %d", got.ClientsServed,
+					got.FailedConnections, got.TotalBytes, tt.want.ClientsServed, tt.want.FailedConnections,
+					tt.want.TotalBytes)
+			}
+
+			if len(got.Countries) != len(tt.want.Countries) {
+				t.Errorf("got countries %v, want %v", got.Countries, tt.want.Countries)
+			}
+
+			for country, count := range tt.want.Countries {
+				if got.Countries[country] != count {
+					t.Errorf("got countries %v, want %v", got.Countries, tt.want.Countries)
+				}
+			}
+
+			if len(got.NatTypeHistory) != len(tt.want.NatTypeHistory) {
+				t.Fatalf("got NAT type history %v, want %v", got.NatTypeHistory, tt.want.NatTypeHistory)
+			}
+
+			for i, change := range tt.want.NatTypeHistory {
+				if got.NatTypeHistory[i].NatType != change.NatType || got.NatTypeHistory[i].Time.IsZero() {
+					t.Errorf("got NAT type history %v, want %v", got.NatTypeHistory, tt.want.NatTypeHistory)
+				}
+			}
+		})
+	}
+}
+
+func TestNatTypeHistoryLimit(t *testing.T) {
+	sp := &SnowflakeProxy{}
+	sp.startStats()
+
+	for i := range maxNatTypeHistory + 10 {
+		if i%2 == 0 {
+			sp.recordNatType(NATRestricted)
+		} else {
+			sp.recordNatType(NATUnrestricted)
+		}
+	}
+
+	if len(sp.stats.NatTypeHistory) != maxNatTypeHistory {
+		t.Errorf("kept %d NAT type changes, want %d", len(sp.stats.NatTypeHistory), maxNatTypeHistory)
+	}
+
+	if last := sp.stats.NatTypeHistory[maxNatTypeHistory-1].NatType; last != NATUnrestricted {
+		t.Errorf("last NAT type %s, want %s", last, NATUnrestricted)
+	}
+}
+
+func TestStatsSurviveRestart(t *testing.T) {
+	dir := t.TempDir()
+
+	sp := &SnowflakeProxy{StateDir: dir}
+
+	for range 2 {
+		sp.startStats()
+		sp.recordClientServed("de")
+		sp.stopStats()
+	}
+
+	sp2 := &SnowflakeProxy{StateDir: dir}
+	sp2.startStats()
+	sp2.recordClientServed("de")
+	sp2.stopStats()
+
+	var got snowflakeLifetimeStats
+	if err := json.Unmarshal([]byte(sp2.LifetimeStats()), &got); err != nil {
+		t.Fatal(err)
+	}
+
+	if got.ClientsServed != 3 || got.Countries["de"] != 3 {
+		t.Errorf("got %d clients, %d from de, want 3", got.ClientsServed, got.Countries["de"])
+	}
+}
@@ -0,0 +1,298 @@
+package IPtProxy
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pion/stun/v3"
+	ptlog "gitlab.torproject.org/tpo/anti-censorship/pluggable-transports/lyrebird/common/log"
+	sfp "gitlab.torproject.org/tpo/anti-censorship/pluggable-transports/snowflake/v2/proxy/lib"
+)
+
+// stunCheckTimeout - Maximum time to wait for the answer of a STUN server.
+const stunCheckTimeout = 5 * time.Second
+
+// stunCheckInterval - How often the STUN servers in use are checked, while the proxy is running.
+const stunCheckInterval = 10 * time.Minute
+
+// errStunUnchecked - Returned for STUN servers, which can't be checked, like ones using TCP or TLS.
+var errStunUnchecked = errors.New("STUN server cannot be checked")
+
+// SnowflakeNatEvents - Interface to get notified about NAT type measurements of the Snowflake proxy and about
+// results of SnowflakeProxy.ProbeNAT.
+type SnowflakeNatEvents interface {
+
+	// NatTypeDetermined - The NAT type was measured.
+	//
+	// @param natType will either be `NATUnknown`, `NATRestricted` or `NATUnrestricted`.
+	//
+	// @param stunServer The STUN server preferred at that time. See SnowflakeProxy.ActiveStunServer.
+	NatTypeDetermined(natType, stunServer string)
+
+	// NatProbeFinished - A probe triggered by SnowflakeProxy.ProbeNAT finished.
+	//
+	// @param natType will either be `NATUnknown`, `NATRestricted` or `NATUnrestricted`.
+	//
+	// @param durationMs The time the probe took in milliseconds.
+	//
+	// @param probeUrl The URL of the NAT probe server used.
+	//
+	// @param stunServer The STUN server preferred during the probe.
+	//
+	// @param error The error which made the probe fail, if any. `natType` will be `NATUnknown` then.
+	NatProbeFinished(natType string, durationMs int64, probeUrl, stunServer string, error error)
+}
+
+// stunResult - The outcome of a health check of a STUN server.
+type stunResult struct {
+	server string
+	rtt    time.Duration
+	err    error
+}
+
+// ActiveStunServer - The STUN server currently preferred by the proxy, which is the healthy one with the shortest
+// round-trip time. All healthy servers are used for ICE gathering, though.
+//
+// @return the STUN URL or an empty string, if the proxy wasn't started, yet.
+func (sp *SnowflakeProxy) ActiveStunServer() string {
+	sp.mutex.Lock()
+	defer sp.mutex.Unlock()
+
+	return sp.activeStunServer
+}
+
+// stunServers returns the configured STUN servers or the defaults.
+func (sp *SnowflakeProxy) stunServers() []string {
+	list := sp.StunServers
+	if list == "" {
+		list = sp.StunServer
+	}
+	if list == "" {
+		list = sfp.DefaultSTUNURL
+	}
+
+	var servers []string
+
+	for _, server := range strings.Split(list, ",") {
+		server = strings.TrimSpace(server)
+
+		if server != "" && !slices.Contains(servers, server) {
+			servers = append(servers, server)
+		}
+	}
+
+	return servers
+}
+
+// validateStunServers checks, if all configured STUN servers are valid URLs.
+func (sp *SnowflakeProxy) validateStunServers() error {
+	for _, server := range sp.stunServers() {
+		if _, err := stun.ParseURI(server); err != nil {
+			return fmt.Errorf("invalid STUN server %s: %w", server, err)
+		}
+	}
+
+	return nil
+}
+
+// checkStunServer sends a binding request to the given STUN server.
+//
+// @return the round-trip time.
+//
+// @throws errStunUnchecked, if the server doesn't use plain STUN over UDP, or another error, if the server is
+// unreachable or answers nonsense.
+func checkStunServer(server string) (time.Duration, error) {
+	uri, err := stun.ParseURI(server)
+	if err != nil {
+		return 0, err
+	}
+
+	// Only plain STUN over UDP can be checked easily.
+	if uri.Scheme != stun.SchemeTypeSTUN || uri.Proto != stun.ProtoTypeUDP {
+		return 0, errStunUnchecked
+	}
+
+	start := time.Now()
+
+	conn, err := net.DialTimeout("udp", net.JoinHostPort(uri.Host, strconv.Itoa(uri.Port)), stunCheckTimeout)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+
+	_ = conn.SetDeadline(start.Add(stunCheckTimeout))
+
+	req := stun.MustBuild(stun.TransactionID, stun.BindingRequest)
+
+	if _, err = conn.Write(req.Raw); err != nil {
+		return 0, err
+	}
+
+	buf := make([]byte, 1500)
+
+	n, err := conn.Read(buf)
+	if err != nil {
+		return 0, err
+	}
+
+	res := &stun.Message{Raw: buf[:n]}
+	if err = res.Decode(); err != nil {
+		return 0, err
+	}
+
+	if res.TransactionID != req.TransactionID || res.Type != stun.BindingSuccess {
+		return 0, errors.New("unexpected STUN response")
+	}
+
+	return time.Since(start), nil
+}
+
+// checkStunServers checks all given STUN servers in parallel.
+func checkStunServers(servers []string) []stunResult {
+	results := make([]stunResult, len(servers))
+
+	var wg sync.WaitGroup
+
+	for i, server := range servers {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			rtt, err := checkStunServer(server)
+			results[i] = stunResult{server: server, rtt: rtt, err: err}
+		}()
+	}
+
+	wg.Wait()
+
+	return results
+}
+
+// healthyStunServers returns the healthy servers of the given results, sorted by round-trip time, followed by the
+// ones which couldn't be checked, in their given order.
+func healthyStunServers(results []stunResult) []string {
+	var healthy, unchecked []stunResult
+
+	for _, result := range results {
+		switch {
+		case result.err == nil:
+			healthy = append(healthy, result)
+
+		case errors.Is(result.err, errStunUnchecked):
+			unchecked = append(unchecked, result)
+
+		default:
+			ptlog.Warnf("STUN server %s failed: %s", result.server, result.err.Error())
+		}
+	}
+
+	slices.SortStableFunc(healthy, func(a, b stunResult) int {
+		return int(a.rtt - b.rtt)
+	})
+
+	servers := make([]string, 0, len(healthy)+len(unchecked))
+	for _, result := range append(healthy, unchecked...) {
+		servers = append(servers, result.server)
+	}
+
+	return servers
+}
+
+// selectStunServers checks all configured STUN servers and selects the healthy ones. Called on every start of the
+// proxy library, as it can't change its STUN servers while running.
+// Unresponsive servers would only delay ICE gathering of every connection, so they're left out.
+//
+// @return the STUN servers to use, the fastest first. All configured ones, if none is healthy.
+func (sp *SnowflakeProxy) selectStunServers() []string {
+	servers := sp.stunServers()
+
+	healthy := healthyStunServers(checkStunServers(servers))
+	if len(healthy) == 0 {
+		ptlog.Warnf("No STUN server reachable, using all of them anyway")
+
+		healthy = servers
+	}
+
+	sp.mutex.Lock()
+	sp.stunServersInUse = healthy
+	sp.activeStunServer = healthy[0]
+	sp.mutex.Unlock()
+
+	ptlog.Noticef("Snowflake proxy uses STUN server %s", healthy[0])
+
+	return healthy
+}
+
+// startStunChecks periodically checks the STUN servers in use.
+func (sp *SnowflakeProxy) startStunChecks() {
+	sp.mutex.Lock()
+	sp.stunShutdown = make(chan struct{})
+	shutdown := sp.stunShutdown
+	sp.mutex.Unlock()
+
+	go func() {
+		ticker := time.NewTicker(stunCheckInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-shutdown:
+				return
+
+			case <-ticker.C:
+				sp.checkStunServersInUse()
+			}
+		}
+	}()
+}
+
+// stopStunChecks stops the periodic checks.
+func (sp *SnowflakeProxy) stopStunChecks() {
+	sp.mutex.Lock()
+	if sp.stunShutdown != nil {
+		close(sp.stunShutdown)
+		sp.stunShutdown = nil
+	}
+	sp.mutex.Unlock()
+}
+
+// checkStunServersInUse rotates to the next healthy STUN server, if the active one failed.
+// The proxy library cannot change its STUN servers while running. If all servers in use failed, the STUN servers
+// are selected again on the next start of the library, e.g. when the proxy resumes after a pause. The proxy isn't
+// restarted for it, since that would disconnect all clients.
+func (sp *SnowflakeProxy) checkStunServersInUse() {
+	sp.mutex.Lock()
+	inUse := sp.stunServersInUse
+	sp.mutex.Unlock()
+
+	healthy := healthyStunServers(checkStunServers(inUse))
+
+	if len(healthy) > 0 {
+		sp.mutex.Lock()
+		if sp.activeStunServer != healthy[0] {
+			ptlog.Noticef("Snowflake proxy rotates to STUN server %s", healthy[0])
+			sp.activeStunServer = healthy[0]
+		}
+		sp.mutex.Unlock()
+
+		return
+	}
+
+	others := slices.DeleteFunc(sp.stunServers(), func(server string) bool {
+		return slices.Contains(inUse, server)
+	})
+
+	if len(others) == 0 || len(healthyStunServers(checkStunServers(others))) == 0 {
+		ptlog.Warnf("No STUN server reachable")
+		return
+	}
+
+	ptlog.Warnf("All STUN servers in use failed, other ones will be used from the next start of the Snowflake proxy")
+}
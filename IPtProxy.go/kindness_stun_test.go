@@ -0,0 +1,106 @@
+package IPtProxy
+
+import (
+	"errors"
+	"net"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/pion/stun/v3"
+)
+
+func TestHealthyStunServers(t *testing.T) {
+	failed := errors.New("failed")
+
+	tests := []struct {
+		name    string
+		results []stunResult
+		want    []string
+	}{
+		{"none", nil, []string{}},
+		{"sorted by rtt", []stunResult{
+			{"stun:a", 30 * time.Millisecond, nil},
+			{"stun:b", 10 * time.Millisecond, nil},
+			{"stun:c", 20 * time.Millisecond, nil},
+		}, []string{"stun:b", "stun:c", "stun:a"}},
+		{"failed left out", []stunResult{
+			{"stun:a", 0, failed},
+			{"stun:b", 10 * time.Millisecond, nil},
+		}, []string{"stun:b"}},
+		{"unchecked last", []stunResult{
+			{"stuns:a", 0, errStunUnchecked},
+			{"stun:b", 50 * time.Millisecond, nil},
+			{"turn:c", 0, errStunUnchecked},
+			{"stun:d", 10 * time.Millisecond, nil},
+		}, []string{"stun:d", "stun:b", "stuns:a", "turn:c"}},
+		{"only unchecked", []stunResult{
+			{"stuns:a", 0, errStunUnchecked},
+			{"stun:b", 0, failed},
+		}, []string{"stuns:a"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := healthyStunServers(tt.results); !slices.Equal(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCheckStunServer(t *testing.T) {
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	go func() {
+		buf := make([]byte, 1500)
+
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+
+			req := &stun.Message{Raw: buf[:n]}
+			if req.Decode() != nil {
+				continue
+			}
+
+			res := stun.MustBuild(stun.NewTransactionIDSetter(req.TransactionID), stun.BindingSuccess)
+			_, _ = conn.WriteTo(res.Raw, addr)
+		}
+	}()
+
+	// Nothing listens there.
+	closed, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closedAddr := closed.LocalAddr().String()
+	_ = closed.Close()
+
+	tests := []struct {
+		server    string
+		unchecked bool
+		wantErr   bool
+	}{
+		{"stun:" + conn.LocalAddr().String(), false, false},
+		{"stun:" + closedAddr, false, true},
+		{"stuns:" + conn.LocalAddr().String(), true, true},
+		{"turn:" + conn.LocalAddr().String() + "?transport=tcp", true, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.server, func(t *testing.T) {
+			_, err := checkStunServer(tt.server)
+
+			if (err != nil) != tt.wantErr || errors.Is(err, errStunUnchecked) != tt.unchecked {
+				t.Errorf("got error %v, want error: %v, unchecked: %v", err, tt.wantErr, tt.unchecked)
+			}
+		})
+	}
+}
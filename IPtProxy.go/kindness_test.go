@@ -0,0 +1,55 @@
+package IPtProxy
+
+import (
+	"testing"
+)
+
+func TestValidateRelayOptions(t *testing.T) {
+	tests := []struct {
+		name    string
+		sp      *SnowflakeProxy
+		wantErr bool
+	}{
+		{"defaults", &SnowflakeProxy{}, false},
+		{"relay url", &SnowflakeProxy{RelayUrl: "wss://snowflake.torproject.net/"}, false},
+		{"relay subdomain", &SnowflakeProxy{RelayUrl: "wss://01.snowflake.torproject.net/"}, false},
+		{"other relay", &SnowflakeProxy{RelayUrl: "wss://snowflake.example.org/"}, true},
+		{"other relay with pattern", &SnowflakeProxy{RelayUrl: "wss://snowflake.example.org/",
+			RelayDomainNamePattern: "example.org$"}, false},
+		{"exact pattern", &SnowflakeProxy{RelayUrl: "wss://snowflake.example.org/",
+			RelayDomainNamePattern: "^example.org$"}, true},
+		{"non-tls relay", &SnowflakeProxy{RelayUrl: "ws://snowflake.torproject.net/"}, true},
+		{"non-tls relay allowed", &SnowflakeProxy{RelayUrl: "ws://snowflake.torproject.net/",
+			AllowNonTLSRelay: true}, true},
+		{"non-tls relay in testing mode", &SnowflakeProxy{RelayUrl: "ws://snowflake.torproject.net/",
+			AllowNonTLSRelay: true, TestingMode: true}, false},
+		{"invalid relay url", &SnowflakeProxy{RelayUrl: "wss://snow flake.torproject.net/"}, true},
+		{"pattern without $", &SnowflakeProxy{RelayDomainNamePattern: "torproject.net"}, true},
+		{"pattern without $ in testing mode", &SnowflakeProxy{RelayDomainNamePattern: "torproject.net",
+			TestingMode: true}, true},
+		{"top-level pattern", &SnowflakeProxy{RelayDomainNamePattern: "net$"}, true},
+		{"empty pattern", &SnowflakeProxy{RelayDomainNamePattern: "$"}, true},
+		{"top-level pattern in testing mode", &SnowflakeProxy{RelayDomainNamePattern: "net$", TestingMode: true},
+			false},
+		{"local addresses", &SnowflakeProxy{KeepLocalAddresses: true}, true},
+		{"local addresses in testing mode", &SnowflakeProxy{KeepLocalAddresses: true, TestingMode: true}, false},
+		{"private addresses", &SnowflakeProxy{AllowProxyingToPrivateAddresses: true}, true},
+		{"private addresses in testing mode", &SnowflakeProxy{AllowProxyingToPrivateAddresses: true,
+			TestingMode: true}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sp := tt.sp
+
+			if sp.RelayDomainNamePattern == "" {
+				sp.RelayDomainNamePattern = defaultRelayDomainNamePattern
+			}
+
+			err := sp.validateRelayOptions()
+			if (err != nil) != tt.wantErr {
+				t.Errorf("got error %v, want error: %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,177 @@
+package IPtProxy
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+
+	pt "gitlab.torproject.org/tpo/anti-censorship/pluggable-transports/goptlib"
+	ptlog "gitlab.torproject.org/tpo/anti-censorship/pluggable-transports/lyrebird/common/log"
+	"gitlab.torproject.org/tpo/anti-censorship/pluggable-transports/lyrebird/transports/base"
+)
+
+// meekFronts returns `MeekFront` and `MeekFronts` as one list without duplicates, `MeekFront` first.
+func (c *Controller) meekFronts() []string {
+	var fronts []string
+
+	for _, front := range strings.Split(c.MeekFront+","+c.MeekFronts, ",") {
+		front = strings.TrimSpace(front)
+
+		if front != "" && !slices.Contains(fronts, front) {
+			fronts = append(fronts, front)
+		}
+	}
+
+	return fronts
+}
+
+// validateMeek checks the Meek defaults.
+func (c *Controller) validateMeek() error {
+	if c.MeekUrl == "" {
+		return nil
+	}
+
+	u, err := url.Parse(c.MeekUrl)
+	if err != nil {
+		return fmt.Errorf("invalid MeekUrl: %w", err)
+	}
+
+	if u.Scheme != "https" && u.Scheme != "http" {
+		return errors.New("MeekUrl must use https:// or http://")
+	}
+
+	return nil
+}
+
+// meekClientFactory - Adds the Meek defaults to every connection, unless the bridge line contains its own, and
+// rotates to the next front, when a connection through the current one fails.
+type meekClientFactory struct {
+	base.ClientFactory
+
+	url             string
+	fronts          []string
+	utls            string
+	transportEvents OnTransportEvents
+
+	mutex sync.Mutex
+	index int
+}
+
+// meekArgs - Parsed Meek arguments, plus the front we added, if any.
+type meekArgs struct {
+	args  interface{}
+	front string
+}
+
+// currentFront returns the front to use for the next connection.
+func (f *meekClientFactory) currentFront() string {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if len(f.fronts) == 0 {
+		return ""
+	}
+
+	return f.fronts[f.index]
+}
+
+// frontFailed rotates to the next front, if the failed one is still the current one.
+func (f *meekClientFactory) frontFailed(front string, err error) {
+	f.mutex.Lock()
+
+	if len(f.fronts) > 1 && f.fronts[f.index] == front {
+		f.index = (f.index + 1) % len(f.fronts)
+
+		ptlog.Warnf("%s front %s failed, rotating to %s", MeekLite, front, f.fronts[f.index])
+	}
+
+	f.mutex.Unlock()
+
+	if f.transportEvents != nil {
+		go f.transportEvents.Error(MeekLite, fmt.Errorf("front %s failed: %w", front, err))
+	}
+}
+
+func (f *meekClientFactory) ParseArgs(args *pt.Args) (interface{}, error) {
+	ma := &meekArgs{}
+
+	// "targets" contains its own list of fronts, which Lyrebird rotates through itself.
+	if _, ok := args.Get("targets"); !ok {
+		if value, ok := args.Get("front"); !ok || value == "" {
+			ma.front = f.currentFront()
+		}
+
+		extraArgs := &pt.Args{}
+		extraArgs.Add("url", f.url)
+		extraArgs.Add("front", ma.front)
+		extraArgs.Add("utls", f.utls)
+
+		mergeExtraArgs(*args, extraArgs)
+	}
+
+	var err error
+
+	ma.args, err = f.ClientFactory.ParseArgs(args)
+	if err != nil {
+		return nil, err
+	}
+
+	return ma, nil
+}
+
+func (f *meekClientFactory) Dial(network, address string, dialFn base.DialFunc, args interface{}) (net.Conn, error) {
+	ma, ok := args.(*meekArgs)
+	if !ok {
+		return nil, errors.New("invalid argument type for args")
+	}
+
+	conn, err := f.ClientFactory.Dial(network, address, dialFn, ma.args)
+	if err != nil {
+		if ma.front != "" {
+			f.frontFailed(ma.front, err)
+		}
+
+		return nil, err
+	}
+
+	if ma.front == "" {
+		return conn, nil
+	}
+
+	return &meekConn{Conn: conn, factory: f, front: ma.front}, nil
+}
+
+// meekConn - Meek connects lazily, so a front failure usually only shows on the first read. This detects that.
+type meekConn struct {
+	net.Conn
+
+	factory *meekClientFactory
+	front   string
+	once    sync.Once
+}
+
+func (c *meekConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+
+	if n > 0 {
+		// The front works.
+		c.once.Do(func() {})
+	} else if err != nil {
+		c.once.Do(func() {
+			c.factory.frontFailed(c.front, err)
+		})
+	}
+
+	return n, err
+}
+
+func (c *meekConn) Close() error {
+	// Closed by us, that's no failure of the front.
+	c.once.Do(func() {})
+
+	return c.Conn.Close()
+}
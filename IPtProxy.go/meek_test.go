@@ -0,0 +1,160 @@
+package IPtProxy
+
+import (
+	"errors"
+	"io"
+	"net"
+	"slices"
+	"strings"
+	"testing"
+
+	pt "gitlab.torproject.org/tpo/anti-censorship/pluggable-transports/goptlib"
+	"gitlab.torproject.org/tpo/anti-censorship/pluggable-transports/lyrebird/transports/base"
+)
+
+// Outcomes of a connection through a front in the tests.
+const (
+	frontDialFails = "dial fails"
+	frontReadFails = "read fails"
+	frontWorks     = "works"
+	frontClosed    = "closed before reading"
+)
+
+// testMeekFactory - Connects according to the outcome configured for the front and records the fronts used.
+type testMeekFactory struct {
+	testClientFactory
+
+	outcomes map[string]string
+	used     []string
+}
+
+func (f *testMeekFactory) Dial(_, _ string, _ base.DialFunc, args interface{}) (net.Conn, error) {
+	front, _ := args.(*pt.Args).Get("front")
+	f.used = append(f.used, front)
+
+	if f.outcomes[front] == frontDialFails {
+		return nil, errors.New("dial failed")
+	}
+
+	local, remote := net.Pipe()
+
+	if f.outcomes[front] == frontWorks {
+		go func() {
+			_, _ = remote.Write([]byte{1})
+		}()
+	} else {
+		_ = remote.Close()
+	}
+
+	return local, nil
+}
+
+func TestMeekFronts(t *testing.T) {
+	tests := []struct {
+		name   string
+		front  string
+		fronts string
+		want   []string
+	}{
+		{"none", "", "", nil},
+		{"front only", "a.example", "", []string{"a.example"}},
+		{"fronts only", "", "a.example, b.example", []string{"a.example", "b.example"}},
+		{"front first", "c.example", "a.example,b.example", []string{"c.example", "a.example", "b.example"}},
+		{"duplicates and blanks", "b.example", " a.example,,b.example ,a.example", []string{"b.example", "a.example"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &Controller{MeekFront: tt.front, MeekFronts: tt.fronts}
+
+			if got := c.meekFronts(); !slices.Equal(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidateMeek(t *testing.T) {
+	tests := []struct {
+		url   string
+		valid bool
+	}{
+		{"", true},
+		{"https://meek.example/", true},
+		{"http://meek.example/", true},
+		{"ftp://meek.example/", false},
+		{"https://meek.example/%zz", false},
+	}
+
+	for _, tt := range tests {
+		c := &Controller{MeekUrl: tt.url}
+
+		if err := c.validateMeek(); (err == nil) != tt.valid {
+			t.Errorf("MeekUrl %s: validation error %v, want valid: %v", tt.url, err, tt.valid)
+		}
+	}
+}
+
+func TestMeekFrontRotation(t *testing.T) {
+	fronts := []string{"a.example", "b.example", "c.example"}
+
+	tests := []struct {
+		name     string
+		fronts   []string
+		outcomes map[string]string
+		line     string
+		dials    int
+		want     []string
+	}{
+		{"working front is kept", fronts, map[string]string{"a.example": frontWorks}, "", 3,
+			[]string{"a.example", "a.example", "a.example"}},
+		{"rotate on dial failure", fronts, map[string]string{"a.example": frontDialFails, "b.example": frontWorks},
+			"", 3, []string{"a.example", "b.example", "b.example"}},
+		{"rotate on read failure", fronts, map[string]string{"a.example": frontReadFails, "b.example": frontWorks},
+			"", 3, []string{"a.example", "b.example", "b.example"}},
+		{"wrap around", fronts, map[string]string{"a.example": frontDialFails, "b.example": frontDialFails,
+			"c.example": frontDialFails}, "", 4, []string{"a.example", "b.example", "c.example", "a.example"}},
+		{"closing is no failure", fronts, map[string]string{"a.example": frontClosed}, "", 2,
+			[]string{"a.example", "a.example"}},
+		{"single front is kept", []string{"a.example"}, map[string]string{"a.example": frontDialFails}, "", 2,
+			[]string{"a.example", "a.example"}},
+		{"bridge line front is never rotated", fronts, map[string]string{"own.example": frontDialFails},
+			"front=own.example", 2, []string{"own.example", "own.example"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			inner := &testMeekFactory{outcomes: tt.outcomes}
+			f := &meekClientFactory{ClientFactory: inner, url: "https://meek.example/", fronts: tt.fronts}
+
+			for range tt.dials {
+				args := pt.Args{}
+				if key, value, ok := strings.Cut(tt.line, "="); ok {
+					args.Add(key, value)
+				}
+
+				parsed, err := f.ParseArgs(&args)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				conn, err := f.Dial("tcp", "192.0.2.20:80", nil, parsed)
+				if err != nil {
+					continue
+				}
+
+				if inner.outcomes[inner.used[len(inner.used)-1]] == frontClosed {
+					_ = conn.Close()
+					continue
+				}
+
+				_, _ = io.ReadFull(conn, make([]byte, 1))
+				_ = conn.Close()
+			}
+
+			if !slices.Equal(inner.used, tt.want) {
+				t.Errorf("used fronts %v, want %v", inner.used, tt.want)
+			}
+		})
+	}
+}
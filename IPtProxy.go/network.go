@@ -0,0 +1,195 @@
+package IPtProxy
+
+import (
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+
+	ptlog "gitlab.torproject.org/tpo/anti-censorship/pluggable-transports/lyrebird/common/log"
+)
+
+// OnNetworkEvents - Interface to get notified about pauses, resumes, connections which were reset due to
+// network changes and DNS resolution failures. Use this to tell your tor instance to rebuild its circuits.
+//
+//goland:noinspection GoUnusedExportedType.
+type OnNetworkEvents interface {
+
+	// Paused - Called when a transport stopped accepting new SOCKS connections due to Controller.Pause.
+	//
+	// @param name The transport name that paused.
+	Paused(name string)
+
+	// Resumed - Called when a transport accepts new SOCKS connections again after Controller.Resume.
+	//
+	// @param name The transport name that resumed.
+	Resumed(name string)
+
+	// ConnectionsReset - Called after Controller.NetworkChanged closed the remote connections of a transport.
+	//
+	// @param name The transport name whose connections were reset.
+	// @param count The number of closed connections. Always 0 with DNSTT, since we cannot count these.
+	ConnectionsReset(name string, count int)
+
+	// ResolutionFailed - Called when a hostname could not be resolved with the custom resolver configured via
+	// `Controller.DnsServer` and `Controller.DnsHosts`.
+	//
+	// @param host The hostname which could not be resolved.
+	// @param error The error that occurred.
+	ResolutionFailed(host string, error error)
+}
+
+// connections - Tracks the established connections of a transport and whether it currently accepts new ones.
+// The local side is either the SOCKS connection or the connection returned by Controller.Dial.
+type connections struct {
+	mutex  sync.Mutex
+	conns  map[io.Closer]net.Conn
+	paused atomic.Bool
+}
+
+func newConnections() *connections {
+	return &connections{conns: make(map[io.Closer]net.Conn)}
+}
+
+func (c *connections) add(local io.Closer, remote net.Conn) {
+	c.mutex.Lock()
+	c.conns[local] = remote
+	c.mutex.Unlock()
+}
+
+func (c *connections) remove(local io.Closer) {
+	c.mutex.Lock()
+	delete(c.conns, local)
+	c.mutex.Unlock()
+}
+
+// closeAll closes all tracked connections on both sides and returns their count.
+func (c *connections) closeAll() int {
+	c.mutex.Lock()
+	conns := c.conns
+	c.conns = make(map[io.Closer]net.Conn)
+	c.mutex.Unlock()
+
+	// Closing outside the lock, since closing a local connection might remove it from the tracker.
+	for local, remote := range conns {
+		_ = remote.Close()
+		_ = local.Close()
+	}
+
+	return len(conns)
+}
+
+// Pause - Temporarily reject new SOCKS connections on all running transports, e.g. while the device has no
+// connectivity. Established connections are left alone.
+//
+// DNSTT will be shut down completely, since we cannot reject single connections there. It will be started again
+// on the same address with Controller.Resume.
+func (c *Controller) Pause() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.paused {
+		return
+	}
+
+	c.paused = true
+
+	for methodName := range c.listeners {
+		if methodName == Dnstt {
+			c.stopDnsttSilently(methodName)
+		} else if conns, ok := c.connections[methodName]; ok {
+			conns.paused.Store(true)
+		}
+
+		ptlog.Noticef("Paused %s", methodName)
+
+		if c.NetworkEvents != nil {
+			go c.NetworkEvents.Paused(methodName)
+		}
+	}
+}
+
+// Resume - Accept new SOCKS connections again after Controller.Pause.
+func (c *Controller) Resume() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if !c.paused {
+		return
+	}
+
+	c.paused = false
+
+	for methodName, ln := range c.listeners {
+		if methodName == Dnstt {
+			if err := c.startDnstt(methodName, ln.Addr().String()); err != nil {
+				ptlog.Errorf("Failed to restart %s: %s", methodName, err.Error())
+
+				delete(c.shutdown, methodName)
+				delete(c.listeners, methodName)
+
+				if c.transportEvents != nil {
+					go c.transportEvents.Stopped(methodName, err)
+				}
+
+				continue
+			}
+		} else if conns, ok := c.connections[methodName]; ok {
+			conns.paused.Store(false)
+		}
+
+		ptlog.Noticef("Resumed %s", methodName)
+
+		if c.NetworkEvents != nil {
+			go c.NetworkEvents.Resumed(methodName)
+		}
+	}
+}
+
+// NetworkChanged - Tell the Controller, that the device switched networks (e.g. from Wi-Fi to cellular).
+//
+// All established remote connections will be closed, since they most probably died silently. With Snowflake, this
+// also discards the collected peers, with DNSTT all sessions. New SOCKS connections will establish everything
+// anew. You should make your tor instance rebuild its circuits afterwards.
+func (c *Controller) NetworkChanged() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.dnsResolver != nil {
+		c.dnsResolver.flush()
+	}
+
+	for methodName, ln := range c.listeners {
+		count := 0
+
+		if methodName == Dnstt {
+			if c.paused {
+				// Will get restarted on resume, anyway.
+				continue
+			}
+
+			c.stopDnsttSilently(methodName)
+
+			if err := c.startDnstt(methodName, ln.Addr().String()); err != nil {
+				ptlog.Errorf("Failed to restart %s: %s", methodName, err.Error())
+
+				delete(c.shutdown, methodName)
+				delete(c.listeners, methodName)
+
+				if c.transportEvents != nil {
+					go c.transportEvents.Stopped(methodName, err)
+				}
+
+				continue
+			}
+		} else if conns, ok := c.connections[methodName]; ok {
+			count = conns.closeAll()
+		}
+
+		ptlog.Noticef("Reset %d connection(s) of %s after network change", count, methodName)
+
+		if c.NetworkEvents != nil {
+			go c.NetworkEvents.ConnectionsReset(methodName, count)
+		}
+	}
+}
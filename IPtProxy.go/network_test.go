@@ -0,0 +1,51 @@
+package IPtProxy
+
+import (
+	"sync"
+	"testing"
+)
+
+func TestControllerConcurrentAccess(t *testing.T) {
+	c := newTestController(t)
+
+	if err := c.Start(Obfs4, ""); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Stop(Obfs4)
+
+	var wg sync.WaitGroup
+
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			for j := 0; j < 50; j++ {
+				c.Pause()
+				c.NetworkChanged()
+				c.Resume()
+
+				if c.LocalAddress(Obfs4) == "" || c.Port(Obfs4) == 0 {
+					t.Error("transport vanished")
+					return
+				}
+
+				_ = c.TorrcLines("")
+
+				if err := c.SetProxy(Obfs4, ""); err != nil {
+					t.Error(err)
+					return
+				}
+
+				_, _ = c.Dial("obfs4 192.0.2.1:1")
+			}
+		}()
+	}
+
+	wg.Wait()
+
+	if c.paused {
+		t.Error("controller still paused")
+	}
+}
@@ -0,0 +1,390 @@
+package IPtProxy
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"golang.org/x/net/proxy"
+)
+
+// proxyHandshakeTimeout - Maximum time to wait for an upstream proxy to finish its handshake.
+const proxyHandshakeTimeout = 30 * time.Second
+
+// httpProxy - A proxy.Dialer which tunnels through an HTTP(S) proxy using the CONNECT method.
+type httpProxy struct {
+	hostPort   string
+	serverName string
+	useTls     bool
+	authHeader string
+	forward    proxy.Dialer
+
+	// rootCAs - The CAs to verify an HTTPS proxy's certificate with. nil uses the system's.
+	rootCAs *x509.CertPool
+}
+
+func newHttpProxy(uri *url.URL, forward proxy.Dialer) (proxy.Dialer, error) {
+	p := &httpProxy{
+		hostPort:   uri.Host,
+		serverName: uri.Hostname(),
+		useTls:     uri.Scheme == "https",
+		forward:    forward,
+	}
+
+	if uri.Port() == "" {
+		if p.useTls {
+			p.hostPort = net.JoinHostPort(uri.Hostname(), "443")
+		} else {
+			p.hostPort = net.JoinHostPort(uri.Hostname(), "80")
+		}
+	}
+
+	if uri.User != nil {
+		password, _ := uri.User.Password()
+		credentials := uri.User.Username() + ":" + password
+		p.authHeader = "Basic " + base64.StdEncoding.EncodeToString([]byte(credentials))
+	}
+
+	return p, nil
+}
+
+func (p *httpProxy) Dial(network, addr string) (net.Conn, error) {
+	return p.DialContext(context.Background(), network, addr)
+}
+
+func (p *httpProxy) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+	default:
+		return nil, fmt.Errorf("http proxy: unsupported network %s", network)
+	}
+
+	conn, err := dialContext(ctx, p.forward, "tcp", p.hostPort)
+	if err != nil {
+		return nil, err
+	}
+
+	if p.useTls {
+		tlsConn := tls.Client(conn, &tls.Config{ServerName: p.serverName, RootCAs: p.rootCAs})
+		_ = tlsConn.SetDeadline(handshakeDeadline(ctx))
+
+		if err = tlsConn.Handshake(); err != nil {
+			_ = conn.Close()
+			return nil, fmt.Errorf("http proxy: TLS handshake failed: %w", err)
+		}
+
+		conn = tlsConn
+	}
+
+	_ = conn.SetDeadline(handshakeDeadline(ctx))
+
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	if p.authHeader != "" {
+		req.Header.Set("Proxy-Authorization", p.authHeader)
+	}
+
+	if err = req.Write(conn); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+
+	reader := bufio.NewReader(conn)
+
+	resp, err := http.ReadResponse(reader, req)
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	_ = resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		_ = conn.Close()
+		return nil, fmt.Errorf("http proxy: CONNECT to %s failed: %s", addr, resp.Status)
+	}
+
+	_ = conn.SetDeadline(time.Time{})
+
+	return &bufferedConn{Conn: conn, reader: reader}, nil
+}
+
+// bufferedConn - A net.Conn which first drains data the proxy handshake already read ahead.
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.reader.Read(b)
+}
+
+// socks4Proxy - A proxy.Dialer which tunnels through a SOCKS4 or SOCKS4a proxy.
+type socks4Proxy struct {
+	hostPort  string
+	userId    string
+	remoteDns bool
+	forward   proxy.Dialer
+}
+
+func newSocks4Proxy(uri *url.URL, forward proxy.Dialer) (proxy.Dialer, error) {
+	p := &socks4Proxy{
+		hostPort:  uri.Host,
+		remoteDns: uri.Scheme == "socks4a",
+		forward:   forward,
+	}
+
+	if uri.Port() == "" {
+		p.hostPort = net.JoinHostPort(uri.Hostname(), "1080")
+	}
+
+	if uri.User != nil {
+		p.userId = uri.User.Username()
+	}
+
+	return p, nil
+}
+
+func (p *socks4Proxy) Dial(network, addr string) (net.Conn, error) {
+	return p.DialContext(context.Background(), network, addr)
+}
+
+func (p *socks4Proxy) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	switch network {
+	case "tcp", "tcp4":
+	default:
+		return nil, fmt.Errorf("socks4 proxy: unsupported network %s", network)
+	}
+
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("socks4 proxy: invalid port %s", portStr)
+	}
+
+	ip := net.ParseIP(host).To4()
+	hostname := ""
+
+	if ip == nil {
+		if net.ParseIP(host) != nil {
+			return nil, errors.New("socks4 proxy: IPv6 addresses are not supported")
+		}
+
+		if p.remoteDns {
+			// SOCKS4a: Use an invalid IP 0.0.0.x and let the proxy resolve the hostname.
+			ip = net.IPv4(0, 0, 0, 1).To4()
+			hostname = host
+		} else {
+			// Use the same resolver as for all other connections, e.g. the one configured via `DnsServer`.
+			resolver := net.DefaultResolver
+			if d, ok := p.forward.(*net.Dialer); ok && d.Resolver != nil {
+				resolver = d.Resolver
+			}
+
+			addrs, err := resolver.LookupIP(ctx, "ip", host)
+			if err != nil {
+				return nil, err
+			}
+
+			for _, a := range addrs {
+				if ip = a.To4(); ip != nil {
+					break
+				}
+			}
+
+			if ip == nil {
+				return nil, fmt.Errorf("socks4 proxy: no IPv4 address found for %s", host)
+			}
+		}
+	}
+
+	conn, err := dialContext(ctx, p.forward, "tcp", p.hostPort)
+	if err != nil {
+		return nil, err
+	}
+
+	_ = conn.SetDeadline(handshakeDeadline(ctx))
+
+	req := []byte{0x04, 0x01}
+	req = binary.BigEndian.AppendUint16(req, uint16(port))
+	req = append(req, ip...)
+	req = append(req, p.userId...)
+	req = append(req, 0)
+	if hostname != "" {
+		req = append(req, hostname...)
+		req = append(req, 0)
+	}
+
+	if _, err = conn.Write(req); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+
+	resp := make([]byte, 8)
+	if _, err = io.ReadFull(conn, resp); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+
+	if resp[0] != 0x00 {
+		_ = conn.Close()
+		return nil, fmt.Errorf("socks4 proxy: invalid reply version %d", resp[0])
+	}
+
+	switch resp[1] {
+	case 0x5a:
+	case 0x5b:
+		_ = conn.Close()
+		return nil, errors.New("socks4 proxy: request rejected or failed")
+	case 0x5c:
+		_ = conn.Close()
+		return nil, errors.New("socks4 proxy: request rejected, identd unreachable")
+	case 0x5d:
+		_ = conn.Close()
+		return nil, errors.New("socks4 proxy: request rejected, user ID mismatch")
+	default:
+		_ = conn.Close()
+		return nil, fmt.Errorf("socks4 proxy: unknown reply code %d", resp[1])
+	}
+
+	_ = conn.SetDeadline(time.Time{})
+
+	return conn, nil
+}
+
+// dialContext dials with the given dialer and aborts, when the context is done, if the dialer supports that.
+func dialContext(ctx context.Context, dialer proxy.Dialer, network, addr string) (net.Conn, error) {
+	if cd, ok := dialer.(proxy.ContextDialer); ok {
+		return cd.DialContext(ctx, network, addr)
+	}
+
+	return dialer.Dial(network, addr)
+}
+
+// handshakeDeadline returns the deadline for a proxy handshake: `proxyHandshakeTimeout` from now, or the context's
+// deadline, if that's earlier.
+func handshakeDeadline(ctx context.Context) time.Time {
+	deadline := time.Now().Add(proxyHandshakeTimeout)
+
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		return d
+	}
+
+	return deadline
+}
+
+// proxyCheckTimeout - Maximum time to wait when testing an upstream proxy for reachability and, if requested, for
+// the check connection through it.
+const proxyCheckTimeout = 10 * time.Second
+
+// upstreamProxy - A proxy.Dialer, which can be swapped out while a transport is running.
+type upstreamProxy struct {
+	mutex  sync.RWMutex
+	dialer proxy.Dialer
+}
+
+func (p *upstreamProxy) Dial(network, addr string) (net.Conn, error) {
+	p.mutex.RLock()
+	dialer := p.dialer
+	p.mutex.RUnlock()
+
+	return dialer.Dial(network, addr)
+}
+
+func (p *upstreamProxy) set(dialer proxy.Dialer) {
+	p.mutex.Lock()
+	p.dialer = dialer
+	p.mutex.Unlock()
+}
+
+// newProxyDialer parses the given proxy URL, constructs a dialer for it, which connects to the proxy using the
+// given forward dialer, and tests, that the proxy is reachable.
+// If checkTarget is not empty, a full connection to that address is made through the proxy, which also verifies
+// the credentials, if any.
+//
+// An empty proxy URL will return the forward dialer itself.
+func newProxyDialer(proxyUrl, checkTarget string, forward proxy.Dialer) (proxy.Dialer, error) {
+	if proxyUrl == "" {
+		return forward, nil
+	}
+
+	uri, err := url.Parse(proxyUrl)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse proxy address: %w", err)
+	}
+
+	if uri.Hostname() == "" {
+		return nil, fmt.Errorf("proxy address %s contains no host", proxyUrl)
+	}
+
+	var dialer proxy.Dialer
+
+	// `golang.org/x/net/proxy` only knows about SOCKS5. Its registry of other schemes is process-wide, so the
+	// others are constructed here.
+	switch uri.Scheme {
+	case "http", "https":
+		dialer, err = newHttpProxy(uri, forward)
+
+	case "socks4", "socks4a":
+		dialer, err = newSocks4Proxy(uri, forward)
+
+	case "socks5", "socks5h":
+		dialer, err = proxy.FromURL(uri, forward)
+
+	default:
+		err = fmt.Errorf("unknown scheme %q", uri.Scheme)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unsupported proxy %s: %w", uri.Redacted(), err)
+	}
+
+	hostPort := uri.Host
+	if uri.Port() == "" {
+		switch uri.Scheme {
+		case "http":
+			hostPort = net.JoinHostPort(uri.Hostname(), "80")
+		case "https":
+			hostPort = net.JoinHostPort(uri.Hostname(), "443")
+		default:
+			hostPort = net.JoinHostPort(uri.Hostname(), "1080")
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), proxyCheckTimeout)
+	defer cancel()
+
+	conn, err := dialContext(ctx, forward, "tcp", hostPort)
+	if err != nil {
+		return nil, fmt.Errorf("proxy %s unreachable: %w", uri.Redacted(), err)
+	}
+	_ = conn.Close()
+
+	if checkTarget != "" {
+		conn, err = dialContext(ctx, dialer, "tcp", checkTarget)
+		if err != nil {
+			return nil, fmt.Errorf("proxy %s check connection to %s failed: %w", uri.Redacted(), checkTarget, err)
+		}
+		_ = conn.Close()
+	}
+
+	return dialer, nil
+}
@@ -0,0 +1,550 @@
+package IPtProxy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/net/proxy"
+)
+
+// startEchoServer starts a TCP server, which echoes everything back, as the target behind the proxies.
+func startEchoServer(t *testing.T) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = ln.Close() })
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				defer conn.Close()
+				_, _ = io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	return ln.Addr().String()
+}
+
+// startProxyServer starts a TCP server, which hands every connection to the given proxy protocol handler.
+func startProxyServer(t *testing.T, handle func(conn net.Conn)) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = ln.Close() })
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				defer conn.Close()
+				handle(conn)
+			}()
+		}
+	}()
+
+	return ln.Addr().String()
+}
+
+// relayTo connects to the target and copies data in both directions, until one side is closed.
+func relayTo(conn io.ReadWriter, target string) {
+	remote, err := net.Dial("tcp", target)
+	if err != nil {
+		return
+	}
+	defer remote.Close()
+
+	go func() {
+		_, _ = io.Copy(remote, conn)
+		_ = remote.Close()
+	}()
+
+	_, _ = io.Copy(conn, remote)
+}
+
+// assertEcho checks, that the connection reaches the echo server.
+func assertEcho(t *testing.T, conn net.Conn) {
+	t.Helper()
+	defer conn.Close()
+
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+
+	b := make([]byte, 4)
+	if _, err := io.ReadFull(conn, b); err != nil {
+		t.Fatal(err)
+	}
+
+	if string(b) != "ping" {
+		t.Errorf("got %q through the proxy, expected \"ping\"", b)
+	}
+}
+
+// connectHandler - A stand-in HTTP proxy, which supports the CONNECT method and optional Basic authentication.
+type connectHandler struct {
+	authHeader string
+
+	mutex   sync.Mutex
+	targets []string
+}
+
+func newConnectHandler(user, password string) *connectHandler {
+	h := &connectHandler{}
+
+	if user != "" {
+		h.authHeader = "Basic " + base64.StdEncoding.EncodeToString([]byte(user+":"+password))
+	}
+
+	return h
+}
+
+func (h *connectHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodConnect {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	if h.authHeader != "" && r.Header.Get("Proxy-Authorization") != h.authHeader {
+		w.Header().Set("Proxy-Authenticate", "Basic realm=\"test\"")
+		w.WriteHeader(http.StatusProxyAuthRequired)
+		return
+	}
+
+	h.mutex.Lock()
+	h.targets = append(h.targets, r.Host)
+	h.mutex.Unlock()
+
+	conn, rw, err := w.(http.Hijacker).Hijack()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	_, _ = conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+
+	relayTo(struct {
+		io.Reader
+		io.Writer
+	}{rw, conn}, r.Host)
+}
+
+func (h *connectHandler) lastTarget() string {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	if len(h.targets) == 0 {
+		return ""
+	}
+
+	return h.targets[len(h.targets)-1]
+}
+
+func TestHttpProxy(t *testing.T) {
+	target := startEchoServer(t)
+	handler := newConnectHandler("", "")
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	dialer, err := newProxyDialer(server.URL, target, proxy.Direct)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn, err := dialer.Dial("tcp", target)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assertEcho(t, conn)
+
+	if handler.lastTarget() != target {
+		t.Errorf("proxy was asked for %s, expected %s", handler.lastTarget(), target)
+	}
+}
+
+func TestHttpProxyAuth(t *testing.T) {
+	target := startEchoServer(t)
+	server := httptest.NewServer(newConnectHandler("user", "secret"))
+	defer server.Close()
+
+	u, _ := url.Parse(server.URL)
+	u.User = url.UserPassword("user", "secret")
+
+	dialer, err := newProxyDialer(u.String(), target, proxy.Direct)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn, err := dialer.Dial("tcp", target)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assertEcho(t, conn)
+
+	// Wrong and missing credentials are refused with 407.
+	u.User = url.UserPassword("user", "wrong")
+
+	if _, err = newProxyDialer(u.String(), target, proxy.Direct); err == nil || !strings.Contains(err.Error(), "407") {
+		t.Errorf("expected 407 with wrong credentials, got %v", err)
+	}
+
+	if _, err = newProxyDialer(server.URL, target, proxy.Direct); err == nil || !strings.Contains(err.Error(), "407") {
+		t.Errorf("expected 407 without credentials, got %v", err)
+	}
+
+	// Without a check target, only the reachability of the proxy is tested.
+	u.User = nil
+
+	dialer, err = newProxyDialer(u.String(), "", proxy.Direct)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = dialer.Dial("tcp", target); err == nil || !strings.Contains(err.Error(), "407") {
+		t.Errorf("expected 407 on dial, got %v", err)
+	}
+}
+
+func TestHttpsProxy(t *testing.T) {
+	target := startEchoServer(t)
+	handler := newConnectHandler("user", "secret")
+	server := httptest.NewTLSServer(handler)
+	defer server.Close()
+
+	u, _ := url.Parse(server.URL)
+	u.User = url.UserPassword("user", "secret")
+
+	dialer, err := newHttpProxy(u, proxy.Direct)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The certificate of the test server isn't trusted by the system.
+	if _, err = dialer.Dial("tcp", target); err == nil || !strings.Contains(err.Error(), "TLS handshake failed") {
+		t.Errorf("expected TLS handshake failure, got %v", err)
+	}
+
+	dialer.(*httpProxy).rootCAs = server.Client().Transport.(*http.Transport).TLSClientConfig.RootCAs
+
+	conn, err := dialer.Dial("tcp", target)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assertEcho(t, conn)
+
+	if handler.lastTarget() != target {
+		t.Errorf("proxy was asked for %s, expected %s", handler.lastTarget(), target)
+	}
+}
+
+// socks4Request - A request received by the SOCKS4 stand-in.
+type socks4Request struct {
+	ip       net.IP
+	port     uint16
+	userId   string
+	hostname string
+}
+
+// socks4Handler returns a stand-in SOCKS4/4a proxy, which requires the given user ID, resolves hostnames with
+// `hosts` and reports every request to `requests`.
+func socks4Handler(userId string, hosts map[string]string, requests chan<- socks4Request) func(net.Conn) {
+	return func(conn net.Conn) {
+		reader := bufio.NewReader(conn)
+
+		header := make([]byte, 8)
+		if _, err := io.ReadFull(reader, header); err != nil || header[0] != 0x04 || header[1] != 0x01 {
+			return
+		}
+
+		req := socks4Request{
+			ip:   net.IP(header[4:8]),
+			port: binary.BigEndian.Uint16(header[2:4]),
+		}
+
+		id, err := reader.ReadString(0)
+		if err != nil {
+			return
+		}
+		req.userId = strings.TrimSuffix(id, "\x00")
+
+		target := net.JoinHostPort(req.ip.String(), strconv.Itoa(int(req.port)))
+
+		// SOCKS4a: 0.0.0.x with x != 0 means a hostname follows.
+		if bytes.Equal(req.ip[:3], []byte{0, 0, 0}) && req.ip[3] != 0 {
+			hostname, err := reader.ReadString(0)
+			if err != nil {
+				return
+			}
+			req.hostname = strings.TrimSuffix(hostname, "\x00")
+
+			target = net.JoinHostPort(hosts[req.hostname], strconv.Itoa(int(req.port)))
+		}
+
+		requests <- req
+
+		if req.userId != userId {
+			_, _ = conn.Write([]byte{0x00, 0x5d, 0, 0, 0, 0, 0, 0})
+			return
+		}
+
+		_, _ = conn.Write([]byte{0x00, 0x5a, 0, 0, 0, 0, 0, 0})
+
+		relayTo(struct {
+			io.Reader
+			io.Writer
+		}{reader, conn}, target)
+	}
+}
+
+func TestSocks4Proxy(t *testing.T) {
+	target := startEchoServer(t)
+	requests := make(chan socks4Request, 10)
+	server := startProxyServer(t, socks4Handler("alice", nil, requests))
+
+	dialer, err := newProxyDialer("socks4://alice@"+server, target, proxy.Direct)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := <-requests
+	if req.ip.String() != "127.0.0.1" || req.userId != "alice" || req.hostname != "" {
+		t.Errorf("unexpected request %+v", req)
+	}
+
+	conn, err := dialer.Dial("tcp", target)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assertEcho(t, conn)
+
+	// A wrong user ID is rejected.
+	if _, err = newProxyDialer("socks4://bob@"+server, target, proxy.Direct); err == nil ||
+		!strings.Contains(err.Error(), "user ID mismatch") {
+		t.Errorf("expected user ID mismatch, got %v", err)
+	}
+}
+
+func TestSocks4aProxy(t *testing.T) {
+	target := startEchoServer(t)
+	host, port, _ := net.SplitHostPort(target)
+	requests := make(chan socks4Request, 10)
+	server := startProxyServer(t, socks4Handler("", map[string]string{"echo.test": host}, requests))
+
+	dialer, err := newProxyDialer("socks4a://"+server, "", proxy.Direct)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The hostname can only be resolved by the proxy.
+	conn, err := dialer.Dial("tcp", net.JoinHostPort("echo.test", port))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assertEcho(t, conn)
+
+	req := <-requests
+	if req.ip.String() != "0.0.0.1" || req.hostname != "echo.test" || strconv.Itoa(int(req.port)) != port {
+		t.Errorf("unexpected request %+v", req)
+	}
+}
+
+// socks5Handler returns a stand-in SOCKS5 proxy, which requires username/password authentication.
+func socks5Handler(user, password string) func(net.Conn) {
+	return func(conn net.Conn) {
+		reader := bufio.NewReader(conn)
+
+		// Greeting: VER NMETHODS METHODS...
+		header := make([]byte, 2)
+		if _, err := io.ReadFull(reader, header); err != nil || header[0] != 0x05 {
+			return
+		}
+
+		methods := make([]byte, header[1])
+		if _, err := io.ReadFull(reader, methods); err != nil {
+			return
+		}
+
+		if !bytes.Contains(methods, []byte{0x02}) {
+			_, _ = conn.Write([]byte{0x05, 0xff})
+			return
+		}
+
+		_, _ = conn.Write([]byte{0x05, 0x02})
+
+		// RFC 1929: VER ULEN UNAME PLEN PASSWD
+		readString := func() (string, error) {
+			l, err := reader.ReadByte()
+			if err != nil {
+				return "", err
+			}
+
+			b := make([]byte, l)
+			_, err = io.ReadFull(reader, b)
+
+			return string(b), err
+		}
+
+		if version, err := reader.ReadByte(); err != nil || version != 0x01 {
+			return
+		}
+
+		u, err := readString()
+		if err != nil {
+			return
+		}
+
+		p, err := readString()
+		if err != nil {
+			return
+		}
+
+		if u != user || p != password {
+			_, _ = conn.Write([]byte{0x01, 0x01})
+			return
+		}
+
+		_, _ = conn.Write([]byte{0x01, 0x00})
+
+		// Request: VER CMD RSV ATYP DST.ADDR DST.PORT
+		request := make([]byte, 4)
+		if _, err = io.ReadFull(reader, request); err != nil || request[1] != 0x01 {
+			return
+		}
+
+		var host string
+
+		switch request[3] {
+		case 0x01:
+			ip := make([]byte, 4)
+			if _, err = io.ReadFull(reader, ip); err != nil {
+				return
+			}
+			host = net.IP(ip).String()
+
+		case 0x03:
+			if host, err = readString(); err != nil {
+				return
+			}
+
+		default:
+			return
+		}
+
+		port := make([]byte, 2)
+		if _, err = io.ReadFull(reader, port); err != nil {
+			return
+		}
+
+		_, _ = conn.Write([]byte{0x05, 0x00, 0x00, 0x01, 0, 0, 0, 0, 0, 0})
+
+		relayTo(struct {
+			io.Reader
+			io.Writer
+		}{reader, conn}, net.JoinHostPort(host, fmt.Sprint(binary.BigEndian.Uint16(port))))
+	}
+}
+
+func TestSocks5Proxy(t *testing.T) {
+	target := startEchoServer(t)
+	server := startProxyServer(t, socks5Handler("user", "secret"))
+
+	dialer, err := newProxyDialer("socks5://user:secret@"+server, target, proxy.Direct)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn, err := dialer.Dial("tcp", target)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assertEcho(t, conn)
+
+	// Wrong credentials fail the authentication.
+	if _, err = newProxyDialer("socks5://user:wrong@"+server, target, proxy.Direct); err == nil {
+		t.Error("expected authentication failure with wrong credentials")
+	}
+
+	// No credentials: The proxy doesn't accept any of the offered methods.
+	if _, err = newProxyDialer("socks5://"+server, target, proxy.Direct); err == nil {
+		t.Error("expected failure without credentials")
+	}
+}
+
+func TestProxySchemes(t *testing.T) {
+	if _, err := newProxyDialer("ftp://127.0.0.1:21", "", proxy.Direct); err == nil ||
+		!strings.Contains(err.Error(), "unknown scheme") {
+		t.Errorf("expected unknown scheme, got %v", err)
+	}
+
+	// Other users of `golang.org/x/net/proxy` in the process don't get our dialers.
+	u, _ := url.Parse("http://127.0.0.1:8080")
+
+	if _, err := proxy.FromURL(u, proxy.Direct); err == nil {
+		t.Error("HTTP proxy dialer was registered process-wide")
+	}
+}
+
+func TestProxyDialTimeout(t *testing.T) {
+	target := startEchoServer(t)
+
+	// A proxy, which accepts connections, but never answers.
+	server := startProxyServer(t, func(conn net.Conn) {
+		_, _ = io.Copy(io.Discard, conn)
+	})
+
+	for _, scheme := range []string{"http", "socks4", "socks5"} {
+		u, _ := url.Parse(scheme + "://" + server)
+
+		dialer, err := newProxyDialer(u.String(), "", proxy.Direct)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+		start := time.Now()
+
+		_, err = dialContext(ctx, dialer, "tcp", target)
+		cancel()
+
+		if err == nil {
+			t.Errorf("%s: expected timeout", scheme)
+		}
+
+		if elapsed := time.Since(start); elapsed > 5*time.Second {
+			t.Errorf("%s: dial took %s, deadline was not honored", scheme, elapsed)
+		}
+	}
+}
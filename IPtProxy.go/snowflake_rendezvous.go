@@ -0,0 +1,210 @@
+package IPtProxy
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	pt "gitlab.torproject.org/tpo/anti-censorship/pluggable-transports/goptlib"
+	ptlog "gitlab.torproject.org/tpo/anti-censorship/pluggable-transports/lyrebird/common/log"
+	"gitlab.torproject.org/tpo/anti-censorship/pluggable-transports/lyrebird/transports/base"
+)
+
+const (
+	// RendezvousFronting - Snowflake rendezvous via domain fronting.
+	RendezvousFronting = "fronting"
+
+	// RendezvousAmpCache - Snowflake rendezvous via an AMP cache.
+	RendezvousAmpCache = "ampcache"
+
+	// RendezvousSqs - Snowflake rendezvous via an Amazon SQS queue.
+	RendezvousSqs = "sqs"
+
+	// RendezvousDirect - Snowflake rendezvous with the broker directly.
+	RendezvousDirect = "direct"
+)
+
+// defaultSnowflakeRendezvousMaxFailures - Consecutive failed rendezvous, after which the next method is used.
+const defaultSnowflakeRendezvousMaxFailures = 3
+
+// rendezvousArgNames - All Snowflake arguments which select or configure the rendezvous method.
+var rendezvousArgNames = []string{"url", "front", "fronts", "ampcache", "sqsqueue", "sqscreds"}
+
+// OnSnowflakeRendezvousEvents - Interface to get notified, when Snowflake switches to another rendezvous method.
+//
+//goland:noinspection GoUnusedExportedType.
+type OnSnowflakeRendezvousEvents interface {
+
+	// RendezvousMethodChanged - Called when Snowflake switched to the next rendezvous method of
+	// `Controller.SnowflakeRendezvousMethods`, after the current one failed too often.
+	//
+	// @param from The method which failed, one of `RendezvousFronting`, `RendezvousAmpCache`, `RendezvousSqs` or
+	// `RendezvousDirect`.
+	// @param to The method used from now on.
+	// @param failures The number of consecutive failed rendezvous, which triggered the switch.
+	RendezvousMethodChanged(from, to string, failures int)
+}
+
+// snowflakeRendezvous - The rendezvous methods to go through and their arguments.
+type snowflakeRendezvous struct {
+	methods     []string
+	args        map[string]*pt.Args
+	maxFailures int
+
+	mutex    sync.Mutex
+	index    int
+	failures int
+}
+
+// parseSnowflakeRendezvous parses `SnowflakeRendezvousMethods`.
+//
+// @return nil, if no methods are configured.
+//
+// @throws if a method is unknown or the fields it needs are not set.
+func (c *Controller) parseSnowflakeRendezvous() (*snowflakeRendezvous, error) {
+	r := &snowflakeRendezvous{
+		args:        make(map[string]*pt.Args),
+		maxFailures: c.SnowflakeRendezvousMaxFailures,
+	}
+
+	if r.maxFailures < 1 {
+		r.maxFailures = defaultSnowflakeRendezvousMaxFailures
+	}
+
+	for _, method := range strings.Split(c.SnowflakeRendezvousMethods, ",") {
+		method = strings.ToLower(strings.TrimSpace(method))
+		if method == "" {
+			continue
+		}
+
+		args := &pt.Args{}
+
+		switch method {
+		case RendezvousFronting:
+			if c.SnowflakeBrokerUrl == "" || c.SnowflakeFrontDomains == "" {
+				return nil, fmt.Errorf("rendezvous method %s needs SnowflakeBrokerUrl and SnowflakeFrontDomains", method)
+			}
+
+			args.Add("url", c.SnowflakeBrokerUrl)
+			args.Add("fronts", c.SnowflakeFrontDomains)
+
+		case RendezvousAmpCache:
+			if c.SnowflakeBrokerUrl == "" || c.SnowflakeAmpCacheUrl == "" {
+				return nil, fmt.Errorf("rendezvous method %s needs SnowflakeBrokerUrl and SnowflakeAmpCacheUrl", method)
+			}
+
+			args.Add("url", c.SnowflakeBrokerUrl)
+			args.Add("ampcache", c.SnowflakeAmpCacheUrl)
+			args.Add("fronts", c.SnowflakeFrontDomains)
+
+		case RendezvousSqs:
+			if c.SnowflakeSqsUrl == "" || c.SnowflakeSqsCreds == "" {
+				return nil, fmt.Errorf("rendezvous method %s needs SnowflakeSqsUrl and SnowflakeSqsCreds", method)
+			}
+
+			args.Add("sqsqueue", c.SnowflakeSqsUrl)
+			args.Add("sqscreds", c.SnowflakeSqsCreds)
+
+		case RendezvousDirect:
+			if c.SnowflakeBrokerUrl == "" {
+				return nil, fmt.Errorf("rendezvous method %s needs SnowflakeBrokerUrl", method)
+			}
+
+			args.Add("url", c.SnowflakeBrokerUrl)
+
+		default:
+			return nil, fmt.Errorf("unknown rendezvous method %s", method)
+		}
+
+		r.methods = append(r.methods, method)
+		r.args[method] = args
+	}
+
+	if len(r.methods) == 0 {
+		return nil, nil
+	}
+
+	return r, nil
+}
+
+// current returns the rendezvous method in use.
+func (r *snowflakeRendezvous) current() string {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	return r.methods[r.index]
+}
+
+// brokerRendezvous counts consecutive failed rendezvous and advances to the next method, when there were too many.
+//
+// @return the failed method, the next method and the number of failures, if the method was switched, otherwise two
+// empty strings and 0.
+func (r *snowflakeRendezvous) brokerRendezvous(err error) (string, string, int) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if err == nil {
+		r.failures = 0
+
+		return "", "", 0
+	}
+
+	r.failures++
+
+	if r.failures < r.maxFailures || len(r.methods) < 2 {
+		return "", "", 0
+	}
+
+	failures := r.failures
+	from := r.methods[r.index]
+
+	r.index = (r.index + 1) % len(r.methods)
+	r.failures = 0
+
+	return from, r.methods[r.index], failures
+}
+
+// rendezvousClientFactory - Replaces the rendezvous arguments of every connection with the ones of the current
+// rendezvous method.
+type rendezvousClientFactory struct {
+	base.ClientFactory
+
+	rendezvous *snowflakeRendezvous
+}
+
+func (f *rendezvousClientFactory) ParseArgs(args *pt.Args) (interface{}, error) {
+	for _, name := range rendezvousArgNames {
+		delete(*args, name)
+	}
+
+	mergeExtraArgs(*args, f.rendezvous.args[f.rendezvous.current()])
+
+	return f.ClientFactory.ParseArgs(args)
+}
+
+// snowflakeRendezvousResult handles the result of a Snowflake broker rendezvous. When the method was switched,
+// the existing connections are reset, so tor reconnects using the next method.
+//
+// Snowflake reports rendezvous results synchronously, while it holds locks, which closing a Snowflake connection
+// needs, too. Therefore, the reset happens on its own goroutine.
+func (c *Controller) snowflakeRendezvousResult(r *snowflakeRendezvous, conns *connections, methodName string, err error) {
+	from, to, failures := r.brokerRendezvous(err)
+	if to == "" {
+		return
+	}
+
+	go func() {
+		count := conns.closeAll()
+
+		ptlog.Warnf("%s rendezvous via %s failed %d times, switching to %s, reset %d connection(s)",
+			methodName, from, failures, to, count)
+
+		if c.SnowflakeRendezvousEvents != nil {
+			c.SnowflakeRendezvousEvents.RendezvousMethodChanged(from, to, failures)
+		}
+
+		if c.NetworkEvents != nil {
+			c.NetworkEvents.ConnectionsReset(methodName, count)
+		}
+	}()
+}
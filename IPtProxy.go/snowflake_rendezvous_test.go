@@ -0,0 +1,200 @@
+package IPtProxy
+
+import (
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	pt "gitlab.torproject.org/tpo/anti-censorship/pluggable-transports/goptlib"
+	"gitlab.torproject.org/tpo/anti-censorship/pluggable-transports/lyrebird/transports/base"
+)
+
+// rendezvousEventRecorder - Records the events of a Snowflake rendezvous switch.
+type rendezvousEventRecorder struct {
+	changed chan [3]interface{}
+	reset   chan int
+}
+
+func (r *rendezvousEventRecorder) RendezvousMethodChanged(from, to string, failures int) {
+	r.changed <- [3]interface{}{from, to, failures}
+}
+
+func (r *rendezvousEventRecorder) Paused(string) {}
+
+func (r *rendezvousEventRecorder) Resumed(string) {}
+
+func (r *rendezvousEventRecorder) ConnectionsReset(_ string, count int) {
+	r.reset <- count
+}
+
+func (r *rendezvousEventRecorder) ResolutionFailed(string, error) {}
+
+// lockingConn - Takes a lock on Close, like a Snowflake connection does.
+type lockingConn struct {
+	net.Conn
+	lock *sync.Mutex
+}
+
+func (c *lockingConn) Close() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return c.Conn.Close()
+}
+
+// argsRecorder - A client factory, which only records the arguments it was given.
+type argsRecorder struct {
+	args *pt.Args
+}
+
+func (f *argsRecorder) Transport() base.Transport { return nil }
+
+func (f *argsRecorder) ParseArgs(args *pt.Args) (interface{}, error) {
+	f.args = args
+
+	return args, nil
+}
+
+func (f *argsRecorder) Dial(string, string, base.DialFunc, interface{}) (net.Conn, error) {
+	return nil, errors.New("not implemented")
+}
+
+func (f *argsRecorder) OnEvent(func(base.TransportEvent)) {}
+
+func newRendezvousTestController(events *rendezvousEventRecorder) *Controller {
+	return &Controller{
+		SnowflakeBrokerUrl:             "https://broker.example/",
+		SnowflakeFrontDomains:          "front.example",
+		SnowflakeRendezvousMethods:     "fronting, direct",
+		SnowflakeRendezvousMaxFailures: 2,
+		SnowflakeRendezvousEvents:      events,
+		NetworkEvents:                  events,
+	}
+}
+
+func TestSnowflakeRendezvousFallback(t *testing.T) {
+	events := &rendezvousEventRecorder{make(chan [3]interface{}, 1), make(chan int, 1)}
+	c := newRendezvousTestController(events)
+
+	r, err := c.parseSnowflakeRendezvous()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Snowflake holds this lock, while it reports a rendezvous result, and closing its connections takes it, too.
+	var collectLock sync.Mutex
+
+	conns := newConnections()
+	var peers []net.Conn
+
+	for i := 0; i < 2; i++ {
+		local, localPeer := net.Pipe()
+		remote, remotePeer := net.Pipe()
+
+		conns.add(local, &lockingConn{remote, &collectLock})
+		peers = append(peers, localPeer, remotePeer)
+	}
+
+	done := make(chan struct{})
+
+	go func() {
+		collectLock.Lock()
+		defer collectLock.Unlock()
+
+		for i := 0; i < 2; i++ {
+			c.snowflakeRendezvousResult(r, conns, Snowflake, errors.New("rendezvous failed"))
+		}
+
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("rendezvous result deadlocked")
+	}
+
+	select {
+	case ev := <-events.changed:
+		if ev != [3]interface{}{RendezvousFronting, RendezvousDirect, 2} {
+			t.Errorf("unexpected switch %v", ev)
+		}
+
+	case <-time.After(5 * time.Second):
+		t.Fatal("rendezvous method not switched")
+	}
+
+	select {
+	case count := <-events.reset:
+		if count != 2 {
+			t.Errorf("reset %d connections, expected 2", count)
+		}
+
+	case <-time.After(5 * time.Second):
+		t.Fatal("connections not reset")
+	}
+
+	for _, peer := range peers {
+		_ = peer.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+		if _, err := peer.Read(make([]byte, 1)); err != io.EOF {
+			t.Errorf("connection not closed: %v", err)
+		}
+	}
+
+	// The next connection uses the next method.
+	f := &argsRecorder{}
+	args := &pt.Args{}
+	args.Add("url", "https://bridge-line.example/")
+	args.Add("fronts", "bridge-line-front.example")
+	args.Add("ampcache", "https://cdn.example/")
+	args.Add("fingerprint", "ABCD")
+
+	if _, err = (&rendezvousClientFactory{f, r}).ParseArgs(args); err != nil {
+		t.Fatal(err)
+	}
+
+	if url, _ := f.args.Get("url"); url != c.SnowflakeBrokerUrl {
+		t.Errorf("url is %s, expected %s", url, c.SnowflakeBrokerUrl)
+	}
+
+	for _, name := range []string{"front", "fronts", "ampcache"} {
+		if _, ok := f.args.Get(name); ok {
+			t.Errorf("direct rendezvous shouldn't have %s", name)
+		}
+	}
+
+	if fingerprint, _ := f.args.Get("fingerprint"); fingerprint != "ABCD" {
+		t.Errorf("fingerprint is %s, expected ABCD", fingerprint)
+	}
+}
+
+func TestSnowflakeRendezvousSuccessResetsFailures(t *testing.T) {
+	events := &rendezvousEventRecorder{make(chan [3]interface{}, 1), make(chan int, 1)}
+	c := newRendezvousTestController(events)
+
+	r, err := c.parseSnowflakeRendezvous()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conns := newConnections()
+
+	c.snowflakeRendezvousResult(r, conns, Snowflake, errors.New("rendezvous failed"))
+	c.snowflakeRendezvousResult(r, conns, Snowflake, nil)
+	c.snowflakeRendezvousResult(r, conns, Snowflake, errors.New("rendezvous failed"))
+
+	if method := r.current(); method != RendezvousFronting {
+		t.Errorf("switched to %s after non-consecutive failures", method)
+	}
+
+	select {
+	case ev := <-events.changed:
+		t.Errorf("unexpected switch %v", ev)
+
+	case <-time.After(100 * time.Millisecond):
+	}
+}
@@ -0,0 +1,167 @@
+package IPtProxy
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"syscall"
+
+	"golang.org/x/net/proxy"
+)
+
+// SocketProtector - Interface to get hold of outbound sockets before they connect.
+//
+// On Android, implement this with `VpnService.protect(fd)`, so transport traffic doesn't loop back into your tun
+// interface.
+//
+//goland:noinspection GoUnusedExportedType.
+type SocketProtector interface {
+
+	// Protect - Called with the file descriptor of every outbound socket before it connects.
+	//
+	// @param fd The file descriptor of the socket.
+	//
+	// @return true, if the socket was successfully protected, false, if it should not be used.
+	Protect(fd int) bool
+}
+
+// errSocketNotProtected - Returned when SocketProtector.Protect refused a socket.
+var errSocketNotProtected = errors.New("socket protector refused outbound socket")
+
+// outboundDialer creates the dialer all outbound connections of Lyrebird transports are based on, respecting
+// `SocketProtector`, `BindAddress`, `BindInterface` and the custom resolver configured via `DnsServer` and
+// `DnsHosts`.
+func (c *Controller) outboundDialer() (proxy.Dialer, error) {
+	if c.SocketProtector == nil && c.BindAddress == "" && c.BindInterface == "" && c.dnsResolver == nil {
+		return proxy.Direct, nil
+	}
+
+	dialer, err := c.protectedDialer()
+	if err != nil {
+		return nil, err
+	}
+
+	if c.dnsResolver != nil {
+		dialer.Resolver = c.dnsResolver.resolver
+	}
+
+	return dialer, nil
+}
+
+// errNoBindAddress - Returned, when a socket cannot be bound, because there's no bind address of its family.
+var errNoBindAddress = errors.New("no bind address for this address family")
+
+// protectedDialer creates a dialer, which respects `SocketProtector`, `BindAddress` and `BindInterface`, but
+// resolves hostnames with the system resolver.
+//
+// Sockets are bound to the IPv4 or IPv6 bind address, depending on the family of their destination, so a hostname
+// with addresses of both families stays reachable via the family which has a bind address.
+func (c *Controller) protectedDialer() (*net.Dialer, error) {
+	dialer := &net.Dialer{}
+
+	ip4, ip6, err := c.bindIps()
+	if err != nil {
+		return nil, err
+	}
+
+	protector := c.SocketProtector
+	bind := ip4 != nil || ip6 != nil
+
+	if protector == nil && !bind {
+		return dialer, nil
+	}
+
+	dialer.Control = func(network, address string, rc syscall.RawConn) error {
+		var ip net.IP
+
+		if bind {
+			// The network is always given with its family here, e.g. "tcp4" or "udp6".
+			if strings.HasSuffix(network, "6") {
+				ip = ip6
+			} else {
+				ip = ip4
+			}
+
+			if ip == nil {
+				return errNoBindAddress
+			}
+		}
+
+		ok := true
+		var bindErr error
+
+		err := rc.Control(func(fd uintptr) {
+			if protector != nil {
+				ok = protector.Protect(int(fd))
+			}
+
+			if ok && ip != nil {
+				bindErr = bindSocket(fd, ip)
+			}
+		})
+		if err != nil {
+			return err
+		}
+
+		if !ok {
+			return errSocketNotProtected
+		}
+
+		return bindErr
+	}
+
+	return dialer, nil
+}
+
+// bindIps returns the local IPv4 and IPv6 addresses to bind outbound sockets to. Both are nil, if none configured.
+// `BindAddress` takes precedence over `BindInterface`.
+func (c *Controller) bindIps() (ip4, ip6 net.IP, err error) {
+	if c.BindAddress != "" {
+		ip := net.ParseIP(c.BindAddress)
+		if ip == nil {
+			return nil, nil, fmt.Errorf("invalid bind address %s", c.BindAddress)
+		}
+
+		if ip.To4() != nil {
+			return ip.To4(), nil, nil
+		}
+
+		return nil, ip, nil
+	}
+
+	if c.BindInterface == "" {
+		return nil, nil, nil
+	}
+
+	iface, err := net.InterfaceByName(c.BindInterface)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid bind interface %s: %w", c.BindInterface, err)
+	}
+
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid bind interface %s: %w", c.BindInterface, err)
+	}
+
+	for _, addr := range addrs {
+		ipNet, ok := addr.(*net.IPNet)
+		if !ok || ipNet.IP.IsLinkLocalUnicast() {
+			continue
+		}
+
+		if ipNet.IP.To4() != nil {
+			if ip4 == nil {
+				ip4 = ipNet.IP.To4()
+			}
+		} else if ip6 == nil {
+			ip6 = ipNet.IP
+		}
+	}
+
+	if ip4 == nil && ip6 == nil {
+		return nil, nil, fmt.Errorf("bind interface %s has no usable address", c.BindInterface)
+	}
+
+	return ip4, ip6, nil
+}
@@ -0,0 +1,13 @@
+//go:build !unix
+
+package IPtProxy
+
+import (
+	"errors"
+	"net"
+)
+
+// bindSocket is not available on this platform.
+func bindSocket(uintptr, net.IP) error {
+	return errors.New("binding outbound sockets is not supported on this platform")
+}
@@ -0,0 +1,86 @@
+package IPtProxy
+
+import (
+	"errors"
+	"net"
+	"testing"
+)
+
+func TestBindAddressFamily(t *testing.T) {
+	ln4, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln4.Close()
+
+	ln6, err := net.Listen("tcp6", "[::1]:0")
+	if err != nil {
+		t.Skip("IPv6 loopback not available")
+	}
+	defer ln6.Close()
+
+	for _, ln := range []net.Listener{ln4, ln6} {
+		go func() {
+			for {
+				conn, err := ln.Accept()
+				if err != nil {
+					return
+				}
+
+				_ = conn.Close()
+			}
+		}()
+	}
+
+	tests := []struct {
+		name          string
+		bindAddress   string
+		bindInterface string
+		target        string
+		local         string
+		err           error
+	}{
+		{"address v4 to v4", "127.0.0.1", "", ln4.Addr().String(), "127.0.0.1", nil},
+		{"address v4 to v6", "127.0.0.1", "", ln6.Addr().String(), "", errNoBindAddress},
+		{"address v6 to v6", "::1", "", ln6.Addr().String(), "::1", nil},
+		{"interface to v4", "", "lo", ln4.Addr().String(), "127.0.0.1", nil},
+		{"interface to v6", "", "lo", ln6.Addr().String(), "::1", nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.bindInterface != "" {
+				if _, err := net.InterfaceByName(tt.bindInterface); err != nil {
+					t.Skip("no interface " + tt.bindInterface)
+				}
+			}
+
+			c := newTestController(t)
+			c.BindAddress = tt.bindAddress
+			c.BindInterface = tt.bindInterface
+
+			dialer, err := c.protectedDialer()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			conn, err := dialer.Dial("tcp", tt.target)
+			if tt.err != nil {
+				if !errors.Is(err, tt.err) {
+					t.Errorf("expected %v, got %v", tt.err, err)
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+
+			if ip := conn.LocalAddr().(*net.TCPAddr).IP.String(); ip != tt.local {
+				t.Errorf("bound to %s, expected %s", ip, tt.local)
+			}
+		})
+	}
+}
@@ -0,0 +1,23 @@
+//go:build unix
+
+package IPtProxy
+
+import (
+	"net"
+	"syscall"
+)
+
+// bindSocket binds the socket to the given local IP address and a random port.
+func bindSocket(fd uintptr, ip net.IP) error {
+	if ip4 := ip.To4(); ip4 != nil {
+		sa := &syscall.SockaddrInet4{}
+		copy(sa.Addr[:], ip4)
+
+		return syscall.Bind(int(fd), sa)
+	}
+
+	sa := &syscall.SockaddrInet6{}
+	copy(sa.Addr[:], ip.To16())
+
+	return syscall.Bind(int(fd), sa)
+}
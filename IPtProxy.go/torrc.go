@@ -0,0 +1,111 @@
+package IPtProxy
+
+import (
+	"errors"
+	"path"
+	"slices"
+	"strings"
+
+	ptlog "gitlab.torproject.org/tpo/anti-censorship/pluggable-transports/lyrebird/common/log"
+)
+
+// TorrcFileName - the filename of the torrc fragment written by Controller.WriteTorrc, residing in `StateDir`.
+const TorrcFileName = "torrc-bridges"
+
+// errNoUsableBridges - Returned, when none of the given bridges can be used with the running transports.
+var errNoUsableBridges = errors.New("no usable bridges")
+
+// TorrcLines - Generate a torrc fragment to use the running transports with the given bridges:
+// "UseBridges 1", a "ClientTransportPlugin" line per running transport and a "Bridge" line per usable bridge.
+//
+// Bridges using a transport which is not running are left out. Bridges without a transport (plain Tor bridges) are
+// always kept.
+//
+// @param bridges Newline-separated bridge lines, with or without the leading "Bridge" keyword, as e.g. provided by
+// BridgeDB or Moat. Empty lines and comments starting with "#" are ignored.
+//
+// @return the torrc fragment, one option per line. Empty, if no bridge is usable, as tor can't connect with
+// "UseBridges 1" but without bridges.
+func (c *Controller) TorrcLines(bridges string) string {
+	lines := c.torrcLines(bridges)
+	if len(lines) == 0 {
+		return ""
+	}
+
+	return strings.Join(lines, "\n") + "\n"
+}
+
+// torrcLines returns the lines of the torrc fragment or nil, if no bridge is usable.
+func (c *Controller) torrcLines(bridges string) []string {
+	var methods []string
+	addresses := make(map[string]string)
+
+	c.mutex.Lock()
+	for methodName, ln := range c.listeners {
+		methods = append(methods, methodName)
+		addresses[methodName] = ln.Addr().String()
+	}
+	c.mutex.Unlock()
+
+	slices.Sort(methods)
+
+	var bridgeLines []string
+
+	for _, bridge := range strings.Split(bridges, "\n") {
+		bridge = strings.TrimSpace(bridge)
+
+		if bridge == "" || strings.HasPrefix(bridge, "#") {
+			continue
+		}
+
+		fields := bridgeLineFields(bridge)
+		if len(fields) == 0 {
+			continue
+		}
+
+		// A plain bridge starts with its address, which always contains a ":".
+		if !strings.Contains(fields[0], ":") && !slices.Contains(methods, fields[0]) {
+			ptlog.Warnf("Transport %s is not running, ignoring bridge", fields[0])
+			continue
+		}
+
+		bridgeLines = append(bridgeLines, "Bridge "+strings.Join(fields, " "))
+	}
+
+	if len(bridgeLines) == 0 {
+		ptlog.Warnf("No usable bridges for the running transports")
+		return nil
+	}
+
+	lines := []string{"UseBridges 1"}
+
+	for _, methodName := range methods {
+		lines = append(lines, "ClientTransportPlugin "+methodName+" socks5 "+addresses[methodName])
+	}
+
+	return append(lines, bridgeLines...)
+}
+
+// WriteTorrc - Write the torrc fragment generated by Controller.TorrcLines to `TorrcFileName` in `StateDir`,
+// so it can be included with tor's `%include` directive or passed via `-f`.
+//
+// @param bridges Newline-separated bridge lines. See Controller.TorrcLines.
+//
+// @return the path of the written file.
+//
+// @throws if no bridge is usable with the running transports, or if the file could not be written.
+func (c *Controller) WriteTorrc(bridges string) (string, error) {
+	lines := c.TorrcLines(bridges)
+	if lines == "" {
+		return "", errNoUsableBridges
+	}
+
+	file := path.Join(c.stateDir, TorrcFileName)
+
+	if err := writeFileAtomically(file, []byte(lines)); err != nil {
+		ptlog.Errorf("Failed to write %s: %s", file, err.Error())
+		return "", err
+	}
+
+	return file, nil
+}
@@ -0,0 +1,80 @@
+package IPtProxy
+
+import (
+	"errors"
+	"os"
+	"testing"
+
+	pt "gitlab.torproject.org/tpo/anti-censorship/pluggable-transports/goptlib"
+)
+
+func TestTorrcLines(t *testing.T) {
+	c := newTestController(t)
+
+	for _, methodName := range []string{Obfs4, MeekLite} {
+		ln, err := pt.ListenSocks("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer ln.Close()
+
+		c.listeners[methodName] = ln
+	}
+
+	meekAddr := c.listeners[MeekLite].Addr().String()
+	obfs4Addr := c.listeners[Obfs4].Addr().String()
+
+	header := "UseBridges 1\n" +
+		"ClientTransportPlugin meek_lite socks5 " + meekAddr + "\n" +
+		"ClientTransportPlugin obfs4 socks5 " + obfs4Addr + "\n"
+
+	tests := []struct {
+		name    string
+		bridges string
+		want    string
+	}{
+		{"no bridges", "", ""},
+		{"only comments", "# obfs4 192.0.2.1:443 cert=abc\n\n", ""},
+		{"only bridges of stopped transports", "snowflake 192.0.2.3:80 2B28", ""},
+		{"obfs4", "obfs4 192.0.2.1:443 FINGERPRINT cert=abc iat-mode=0",
+			header + "Bridge obfs4 192.0.2.1:443 FINGERPRINT cert=abc iat-mode=0\n"},
+		{"keyword stripped", "Bridge obfs4 192.0.2.1:443 FINGERPRINT cert=abc",
+			header + "Bridge obfs4 192.0.2.1:443 FINGERPRINT cert=abc\n"},
+		{"plain bridge", "192.0.2.2:9001 FINGERPRINT",
+			header + "Bridge 192.0.2.2:9001 FINGERPRINT\n"},
+		{"mixed", "# comment\n  obfs4 192.0.2.1:443 FP cert=abc \nsnowflake 192.0.2.3:80 2B28\n" +
+			"meek_lite 192.0.2.4:80 url=https://example.com/ front=example.org\n",
+			header + "Bridge obfs4 192.0.2.1:443 FP cert=abc\n" +
+				"Bridge meek_lite 192.0.2.4:80 url=https://example.com/ front=example.org\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := c.TorrcLines(tt.bridges); got != tt.want {
+				t.Errorf("got:\n%s\nwant:\n%s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWriteTorrc(t *testing.T) {
+	c := newTestController(t)
+
+	if _, err := c.WriteTorrc("obfs4 192.0.2.1:443 FP cert=abc"); !errors.Is(err, errNoUsableBridges) {
+		t.Errorf("wrote torrc without running transports: %v", err)
+	}
+
+	file, err := c.WriteTorrc("192.0.2.2:9001 FINGERPRINT")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if want := "UseBridges 1\nBridge 192.0.2.2:9001 FINGERPRINT\n"; string(data) != want {
+		t.Errorf("got:\n%s\nwant:\n%s", data, want)
+	}
+}
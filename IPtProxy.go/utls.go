@@ -0,0 +1,190 @@
+package IPtProxy
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"strconv"
+	"strings"
+
+	utls "github.com/refraction-networking/utls"
+	ptlog "gitlab.torproject.org/tpo/anti-censorship/pluggable-transports/lyrebird/common/log"
+	"gitlab.torproject.org/tpo/anti-censorship/pluggable-transports/lyrebird/common/utlsutil"
+	ptutls "gitlab.torproject.org/tpo/anti-censorship/pluggable-transports/ptutil/utls"
+	dnsttclient "www.bamsoftware.com/git/dnstt.git/dnstt-client/lib"
+)
+
+// defaultDnsttUtlsDistribution - The uTLS distribution DNSTT uses, if no `Controller.UtlsPolicy` is set.
+const defaultDnsttUtlsDistribution = "4*random,3*Firefox_120,1*Firefox_105,3*Chrome_120,1*Chrome_102,1*iOS_14,1*iOS_13"
+
+// OnUtlsEvents - Interface to get notified about the TLS fingerprint a transport uses.
+//
+//goland:noinspection GoUnusedExportedType.
+type OnUtlsEvents interface {
+
+	// FingerprintSelected - Called when a transport was started with a TLS fingerprint chosen by
+	// `Controller.UtlsPolicy`.
+	//
+	// The fingerprint is chosen per transport on every Controller.Start, so every started transport gets its own
+	// call, and transports may use different fingerprints. No call is made for a transport, which doesn't support
+	// the chosen fingerprint and uses its own default instead: Snowflake supports fewer fingerprints than the
+	// others, so such a fingerprint is only logged as a warning, while other transports may already have reported
+	// theirs.
+	//
+	// @param name The transport name.
+	// @param fingerprint The uTLS ClientHello ID, e.g. "hellochrome_auto", or "none" for Go's own TLS stack.
+	FingerprintSelected(name, fingerprint string)
+}
+
+// utlsChoice - One entry of a `Controller.UtlsPolicy`.
+type utlsChoice struct {
+	fingerprint string
+	weight      int
+}
+
+// normalizeUtlsName converts the short forms allowed in `Controller.UtlsPolicy` into the names used by Lyrebird.
+func normalizeUtlsName(name string) string {
+	name = strings.ToLower(strings.TrimSpace(name))
+
+	switch name {
+	case "none", "":
+		return name
+
+	case "golang", "hellogolang":
+		return "none"
+
+	case "random", "randomized":
+		return "hellorandomizedalpn"
+	}
+
+	if !strings.HasPrefix(name, "hello") {
+		name = "hello" + name
+	}
+
+	return name
+}
+
+// parseUtlsPolicy parses a policy like "hellochrome_auto", "random" or "3*chrome_auto,1*firefox_auto,1*random".
+//
+// @throws if a weight or a fingerprint is invalid.
+func parseUtlsPolicy(policy string) ([]utlsChoice, error) {
+	var choices []utlsChoice
+
+	for _, entry := range strings.Split(policy, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		weight := 1
+		name := entry
+
+		if w, n, ok := strings.Cut(entry, "*"); ok {
+			var err error
+
+			weight, err = strconv.Atoi(strings.TrimSpace(w))
+			if err != nil || weight < 1 {
+				return nil, fmt.Errorf("invalid uTLS weight in \"%s\"", entry)
+			}
+
+			name = n
+		}
+
+		name = normalizeUtlsName(name)
+
+		if name != "none" {
+			if _, err := utlsutil.ParseClientHelloID(name); err != nil || name == "" {
+				return nil, fmt.Errorf("invalid uTLS fingerprint in \"%s\"", entry)
+			}
+		}
+
+		choices = append(choices, utlsChoice{name, weight})
+	}
+
+	return choices, nil
+}
+
+// sampleUtlsPolicy chooses one fingerprint according to the weights.
+func sampleUtlsPolicy(choices []utlsChoice) string {
+	total := 0
+	for _, choice := range choices {
+		total += choice.weight
+	}
+
+	if total < 1 {
+		return ""
+	}
+
+	r := rand.IntN(total)
+
+	for _, choice := range choices {
+		if r < choice.weight {
+			return choice.fingerprint
+		}
+
+		r -= choice.weight
+	}
+
+	return ""
+}
+
+// utlsFingerprint chooses a fingerprint for the given transport according to the `UtlsPolicy`, logs it and reports
+// it to `UtlsEvents`. A fingerprint the transport doesn't support is only logged.
+//
+// @param choices The `UtlsPolicy`, as parsed by Controller.Start.
+//
+// @return the transport argument for the fingerprint or an empty string, if there is no policy or the transport
+// should use its own default.
+func (c *Controller) utlsFingerprint(methodName string, choices []utlsChoice) string {
+	if len(choices) == 0 {
+		return ""
+	}
+
+	fingerprint := sampleUtlsPolicy(choices)
+	arg := fingerprint
+
+	switch methodName {
+	case Webtunnel:
+		// Webtunnel needs HTTP/1.1 for its WebSocket upgrade.
+		if fingerprint == "hellorandomizedalpn" {
+			fingerprint = "hellorandomizednoalpn"
+			arg = fingerprint
+		}
+
+	case Snowflake:
+		// Snowflake uses Go's own TLS stack by default and supports a smaller set of fingerprints.
+		if fingerprint == "none" {
+			arg = ""
+		} else if _, err := ptutls.NameToUTLSID(fingerprint); err != nil {
+			ptlog.Warnf("%s does not support uTLS fingerprint %s, using its default", methodName, fingerprint)
+			return ""
+		}
+	}
+
+	ptlog.Noticef("%s uses uTLS fingerprint %s", methodName, fingerprint)
+
+	if c.UtlsEvents != nil {
+		go c.UtlsEvents.FingerprintSelected(methodName, fingerprint)
+	}
+
+	return arg
+}
+
+// dnsttClientHelloID chooses the ClientHello ID for DNSTT according to the `UtlsPolicy` or DNSTT's own default
+// distribution.
+//
+// @param choices The `UtlsPolicy`, as parsed by Controller.Start.
+//
+// @return the ClientHello ID or nil, if Go's own TLS stack should be used.
+func (c *Controller) dnsttClientHelloID(choices []utlsChoice) (*utls.ClientHelloID, error) {
+	fingerprint := c.utlsFingerprint(Dnstt, choices)
+
+	if fingerprint == "" {
+		return dnsttclient.SampleUTLSDistribution(defaultDnsttUtlsDistribution)
+	}
+
+	if fingerprint == "none" {
+		return nil, nil
+	}
+
+	return utlsutil.ParseClientHelloID(fingerprint)
+}
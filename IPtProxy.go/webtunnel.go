@@ -0,0 +1,86 @@
+package IPtProxy
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/url"
+
+	pt "gitlab.torproject.org/tpo/anti-censorship/pluggable-transports/goptlib"
+	"gitlab.torproject.org/tpo/anti-censorship/pluggable-transports/lyrebird/common/utlsutil"
+	"gitlab.torproject.org/tpo/anti-censorship/pluggable-transports/lyrebird/transports/base"
+)
+
+// errWebtunnelPinRequired - Returned for Webtunnel connections without a certificate pin, when
+// `Controller.WebtunnelRequirePin` is set.
+var errWebtunnelPinRequired = errors.New("webtunnel bridge has no certificate pin, but a pin is required")
+
+// webtunnelExtraArgs returns the Webtunnel defaults, which are added to every connection, unless the bridge line
+// contains them itself.
+//
+// @param utlsFingerprint The fingerprint chosen by the `UtlsPolicy`. `WebtunnelUtlsFingerprint` takes precedence.
+func (c *Controller) webtunnelExtraArgs(utlsFingerprint string) *pt.Args {
+	if c.WebtunnelUtlsFingerprint != "" {
+		utlsFingerprint = c.WebtunnelUtlsFingerprint
+	}
+
+	extraArgs := &pt.Args{}
+	extraArgs.Add("url", c.WebtunnelUrl)
+	extraArgs.Add("servername", c.WebtunnelServerName)
+	extraArgs.Add("utls", utlsFingerprint)
+	extraArgs.Add("cert", c.WebtunnelCertPin)
+
+	return extraArgs
+}
+
+// validateWebtunnel checks the Webtunnel defaults.
+func (c *Controller) validateWebtunnel() error {
+	if c.WebtunnelUrl != "" {
+		u, err := url.Parse(c.WebtunnelUrl)
+		if err != nil {
+			return fmt.Errorf("invalid WebtunnelUrl: %w", err)
+		}
+
+		if u.Scheme != "https" && u.Scheme != "http" {
+			return errors.New("WebtunnelUrl must use https:// or http://")
+		}
+
+		if u.Scheme == "http" && c.WebtunnelRequirePin {
+			return errors.New("WebtunnelUrl must use https://, when a certificate pin is required")
+		}
+	}
+
+	if c.WebtunnelUtlsFingerprint != "" && c.WebtunnelUtlsFingerprint != "none" {
+		if _, err := utlsutil.ParseClientHelloID(c.WebtunnelUtlsFingerprint); err != nil {
+			return fmt.Errorf("invalid WebtunnelUtlsFingerprint: %w", err)
+		}
+	}
+
+	if c.WebtunnelCertPin != "" {
+		pin, err := base64.StdEncoding.DecodeString(c.WebtunnelCertPin)
+		if err != nil || len(pin) != 32 {
+			return errors.New("invalid WebtunnelCertPin, expected a base64 encoded SHA-256 certificate chain hash")
+		}
+	}
+
+	return nil
+}
+
+// pinningClientFactory - Refuses Webtunnel connections without a certificate pin.
+type pinningClientFactory struct {
+	base.ClientFactory
+}
+
+func (f *pinningClientFactory) ParseArgs(args *pt.Args) (interface{}, error) {
+	if pin, ok := args.Get("cert"); !ok || pin == "" {
+		return nil, errWebtunnelPinRequired
+	}
+
+	if u, ok := args.Get("url"); ok {
+		if parsed, err := url.Parse(u); err == nil && parsed.Scheme != "https" {
+			return nil, errors.New("webtunnel bridge doesn't use TLS, but a certificate pin is required")
+		}
+	}
+
+	return f.ClientFactory.ParseArgs(args)
+}
@@ -0,0 +1,140 @@
+package IPtProxy
+
+import (
+	"errors"
+	"testing"
+
+	pt "gitlab.torproject.org/tpo/anti-censorship/pluggable-transports/goptlib"
+	"gitlab.torproject.org/tpo/anti-censorship/pluggable-transports/lyrebird/transports/base"
+)
+
+// A base64 encoded SHA-256 hash.
+const testWebtunnelPin = "47DEQpj8HBSa+/TImW+5JCeuQeRkm5NMpJWZG3hSuFU="
+
+// testClientFactory - Accepts all arguments, so tests can check, what a wrapping factory passes through.
+type testClientFactory struct {
+	base.ClientFactory
+}
+
+func (f *testClientFactory) ParseArgs(args *pt.Args) (interface{}, error) {
+	return args, nil
+}
+
+func TestValidateWebtunnel(t *testing.T) {
+	tests := []struct {
+		name        string
+		url         string
+		requirePin  bool
+		fingerprint string
+		pin         string
+		valid       bool
+	}{
+		{"nothing", "", false, "", "", true},
+		{"https", "https://example.com/path", false, "", "", true},
+		{"http", "http://example.com/path", false, "", "", true},
+		{"http with pin required", "http://example.com/path", true, "", "", false},
+		{"https with pin required", "https://example.com/path", true, "", testWebtunnelPin, true},
+		{"wrong scheme", "ftp://example.com/path", false, "", "", false},
+		{"invalid url", "https://example.com/%zz", false, "", "", false},
+		{"fingerprint", "", false, "hellochrome_auto", "", true},
+		{"fingerprint none", "", false, "none", "", true},
+		{"unknown fingerprint", "", false, "hellonetscape", "", false},
+		{"pin not base64", "", false, "", "not base64!", false},
+		{"pin too short", "", false, "", "AAAA", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &Controller{
+				WebtunnelUrl:             tt.url,
+				WebtunnelRequirePin:      tt.requirePin,
+				WebtunnelUtlsFingerprint: tt.fingerprint,
+				WebtunnelCertPin:         tt.pin,
+			}
+
+			if err := c.validateWebtunnel(); (err == nil) != tt.valid {
+				t.Errorf("validation error %v, want valid: %v", err, tt.valid)
+			}
+		})
+	}
+}
+
+func TestWebtunnelExtraArgs(t *testing.T) {
+	tests := []struct {
+		name        string
+		fingerprint string
+		policy      string
+		want        string
+	}{
+		{"neither", "", "", ""},
+		{"policy", "", "hellofirefox_auto", "hellofirefox_auto"},
+		{"fingerprint over policy", "hellochrome_auto", "hellofirefox_auto", "hellochrome_auto"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &Controller{
+				WebtunnelUrl:             "https://example.com/path",
+				WebtunnelCertPin:         testWebtunnelPin,
+				WebtunnelUtlsFingerprint: tt.fingerprint,
+			}
+
+			// The bridge line's own arguments win over the defaults.
+			args := pt.Args{}
+			args.Add("url", "https://bridge.example/path")
+			mergeExtraArgs(args, c.webtunnelExtraArgs(tt.policy))
+
+			if got, _ := args.Get("url"); got != "https://bridge.example/path" {
+				t.Errorf("url %s, want the bridge line's", got)
+			}
+
+			if got, _ := args.Get("cert"); got != testWebtunnelPin {
+				t.Errorf("cert %s, want %s", got, testWebtunnelPin)
+			}
+
+			if _, ok := args.Get("servername"); ok {
+				t.Error("empty servername added")
+			}
+
+			if got, _ := args.Get("utls"); got != tt.want {
+				t.Errorf("utls %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPinningClientFactory(t *testing.T) {
+	tests := []struct {
+		name string
+		args map[string]string
+		err  error
+		ok   bool
+	}{
+		{"pin", map[string]string{"url": "https://example.com/", "cert": testWebtunnelPin}, nil, true},
+		{"pin without url", map[string]string{"cert": testWebtunnelPin}, nil, true},
+		{"no pin", map[string]string{"url": "https://example.com/"}, errWebtunnelPinRequired, false},
+		{"empty pin", map[string]string{"url": "https://example.com/", "cert": ""}, errWebtunnelPinRequired, false},
+		{"pin without tls", map[string]string{"url": "http://example.com/", "cert": testWebtunnelPin}, nil, false},
+	}
+
+	f := &pinningClientFactory{&testClientFactory{}}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			args := pt.Args{}
+			for key, value := range tt.args {
+				args.Add(key, value)
+			}
+
+			_, err := f.ParseArgs(&args)
+
+			if (err == nil) != tt.ok {
+				t.Fatalf("got %v, want success: %v", err, tt.ok)
+			}
+
+			if tt.err != nil && !errors.Is(err, tt.err) {
+				t.Errorf("got %v, want %v", err, tt.err)
+			}
+		})
+	}
+}